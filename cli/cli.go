@@ -3,22 +3,43 @@ package cli
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	url2 "net/url"
 	"sort"
+	"strings"
 	"time"
 
+	"github.com/abilitylab/graph/pkg/metadata"
 	"github.com/abilitylab/logger"
 	"go.uber.org/zap"
 )
 
+// ErrNotFound is returned when the server does not know the requested ID.
+var ErrNotFound = errors.New("cli: not found")
+
+// notFoundBody is the body of the 404 the server answers /search-by-id with
+// for an unknown ID, telling it from a 404 for the route.
+const notFoundBody = "id not found"
+
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("error sending request, status code: %d", e.code)
+}
+
 type getSimilarCfg struct {
 	minDistance    float32
 	minDistanceSet bool
 	maxDistance    float32
 	maxDistanceSet bool
+	where          string
+	ef             int
 }
 
 func WithMinDistance(minDistance float32) func(*getSimilarCfg) {
@@ -35,7 +56,85 @@ func WithMaxDistance(maxDistance float32) func(*getSimilarCfg) {
 	}
 }
 
+// WithWhere restricts results to items whose metadata matches the filter
+// expression, see metadata.Parse.
+func WithWhere(where string) func(*getSimilarCfg) {
+	return func(cfg *getSimilarCfg) {
+		cfg.where = where
+	}
+}
+
+// WithEF sets the hnsw search ef for this request only. Higher values trade
+// latency for recall.
+func WithEF(ef int) func(*getSimilarCfg) {
+	return func(cfg *getSimilarCfg) {
+		cfg.ef = ef
+	}
+}
+
+// Result mirrors graph.Result as returned by the ranked search endpoint.
+type Result struct {
+	ID       string  `json:"id"`
+	Distance float32 `json:"distance"`
+	Score    float32 `json:"score"`
+
+	Metadata *metadata.Metadata `json:"metadata,omitempty"`
+}
+
 func GetSimilar(ctx context.Context, hostPost string, vector []float64, limit int, opts ...func(cfg *getSimilarCfg)) (map[string]float32, error) {
+	var r map[string]float32
+	err := search(ctx, hostPost, vector, limit, false, &r, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetSimilarRanked is GetSimilar returning results closest first.
+func GetSimilarRanked(ctx context.Context, hostPost string, vector []float64, limit int, opts ...func(cfg *getSimilarCfg)) ([]Result, error) {
+	var r []Result
+	err := search(ctx, hostPost, vector, limit, true, &r, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func search(ctx context.Context, hostPost string, vector []float64, limit int, ranked bool, out interface{}, opts ...func(cfg *getSimilarCfg)) error {
+	vec, err := VectorToString(vector)
+	if err != nil {
+		logger.Error("error converting vector to string", zap.Error(err))
+		return err
+	}
+
+	q := url2.Values{}
+	q.Add("vector", vec)
+
+	return searchPath(ctx, hostPost, "/search", q, limit, ranked, out, opts...)
+}
+
+// GetSimilarByID returns the items closest to the one stored under id,
+// leaving out id itself. It returns ErrNotFound when id is not indexed.
+func GetSimilarByID(ctx context.Context, hostPost string, id string, limit int, opts ...func(cfg *getSimilarCfg)) ([]Result, error) {
+	q := url2.Values{}
+	q.Add("id", id)
+
+	var r []Result
+	err := searchPath(ctx, hostPost, "/search-by-id", q, limit, true, &r, opts...)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.code == http.StatusNotFound && statusErr.body == notFoundBody {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func searchPath(ctx context.Context, hostPost string, path string, q url2.Values, limit int, ranked bool, out interface{}, opts ...func(cfg *getSimilarCfg)) error {
 	cfg := &getSimilarCfg{
 		minDistance: 0,
 		maxDistance: 0.7,
@@ -50,7 +149,7 @@ func GetSimilar(ctx context.Context, hostPost string, vector []float64, limit in
 		Opaque:      "",
 		User:        nil,
 		Host:        hostPost,
-		Path:        "/search",
+		Path:        path,
 		RawPath:     "",
 		ForceQuery:  false,
 		RawQuery:    "",
@@ -58,15 +157,6 @@ func GetSimilar(ctx context.Context, hostPost string, vector []float64, limit in
 		RawFragment: "",
 	}
 
-	q := u.Query()
-
-	vec, err := VectorToString(vector)
-	if err != nil {
-		logger.Error("error converting vector to string", zap.Error(err))
-		return nil, err
-	}
-
-	q.Add("vector", vec)
 	q.Add("results", fmt.Sprintf("%d", limit))
 	if cfg.minDistanceSet {
 		q.Add("minDistance", fmt.Sprintf("%f", cfg.minDistance))
@@ -74,16 +164,29 @@ func GetSimilar(ctx context.Context, hostPost string, vector []float64, limit in
 	if cfg.maxDistanceSet {
 		q.Add("maxDistance", fmt.Sprintf("%f", cfg.maxDistance))
 	}
+	if cfg.ef > 0 {
+		q.Add("ef", fmt.Sprintf("%d", cfg.ef))
+	}
+	if cfg.where != "" {
+		q.Add("where", cfg.where)
+	}
+	if ranked {
+		q.Add("ranked", "true")
+	}
 
 	u.RawQuery = q.Encode()
 
+	return post(ctx, u, out)
+}
+
+func post(ctx context.Context, u url2.URL, out interface{}) error {
 	reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(reqCtx, "POST", u.String(), nil)
 	if err != nil {
 		logger.Error("error creating request", zap.Error(err))
-		return nil, err
+		return err
 	}
 
 	req.Header.Add("Content-Type", "application/json")
@@ -91,29 +194,29 @@ func GetSimilar(ctx context.Context, hostPost string, vector []float64, limit in
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		logger.Error("error sending request", zap.Error(err))
-		return nil, err
+		return err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		logger.Error("error sending request", zap.Int("status", res.StatusCode))
-		return nil, fmt.Errorf("error sending request, status code: %d", res.StatusCode)
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return &statusError{code: res.StatusCode, body: strings.TrimSpace(string(body))}
 	}
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		logger.Error("error reading response", zap.Error(err))
-		return nil, err
+		return err
 	}
 
-	var r map[string]float32
-	err = json.Unmarshal(body, &r)
+	err = json.Unmarshal(body, out)
 	if err != nil {
 		logger.Error("error unmarshalling response", zap.Error(err))
-		return nil, err
+		return err
 	}
 
-	return r, nil
+	return nil
 }
 
 func VectorToString(vector []float64) (string, error) {
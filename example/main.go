@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/labstack/echo/v4"
@@ -15,7 +16,11 @@ import (
 	"time"
 
 	"github.com/abilitylab/graph/pkg/graph"
+	"github.com/abilitylab/graph/pkg/hybrid"
+	"github.com/abilitylab/graph/pkg/index"
 	"github.com/abilitylab/graph/pkg/inmemory"
+	"github.com/abilitylab/graph/pkg/metadata"
+	"github.com/abilitylab/graph/pkg/query"
 	"github.com/abilitylab/logger"
 	"github.com/labstack/echo/v4/middleware"
 	"go.uber.org/atomic"
@@ -28,22 +33,24 @@ import (
 var (
 	duration    = flag.Duration("duration", 0, "maximum duration to calculate feed vectors")
 	reloadEvery = flag.Duration("reload-every", 0, "reload every duration")
+	snapshotDir = flag.String("snapshot-dir", "", "directory to restore the hnsw graph from and save it to before reloading")
+	backend     = flag.String("backend", string(index.BackendHNSW), "vector search backend: hnsw or bruteforce")
+	recallRate  = flag.Float64("recall-sample-rate", 0.001, "share of hnsw searches rerun exactly to measure recall")
+	tuneRecall  = flag.Float64("tune-recall", 0, "recall@10 the hnsw ef is tuned for as the index grows, 0 keeps the fixed ef")
 )
 
-const hnswEnabled = true
 const dim = 768
 const M = 40
 
-const maxElements = 5000000
+const maxElements = 1000000
 
 const putPostsWorkerCount = 12
 
 var (
+	hnswEnabled   bool
 	hnswGraph     *graph.Service
 	inMemoryGraph *inmemory.Service
-
-	postLabels    = make(map[string]map[string]struct{}, maxElements)
-	postLabelsMtx sync.RWMutex
+	vectorIndex   index.Index
 )
 
 var (
@@ -63,6 +70,8 @@ func init() {
 
 	flag.Parse()
 
+	hnswEnabled = index.Backend(*backend) == index.BackendHNSW
+
 	logger.Info("set duration", zap.Duration("duration", *duration))
 	logger.Info("set reload every", zap.Duration("reload-every", *reloadEvery))
 }
@@ -78,19 +87,49 @@ func main() {
 	if *reloadEvery > 0 {
 		go func() {
 			time.Sleep(*reloadEvery)
+			if hnswEnabled && *snapshotDir != "" {
+				if err := hnswGraph.Save(*snapshotDir); err != nil {
+					logger.Error("hnsw snapshot save failed", zap.Error(err))
+				}
+			}
 			os.Exit(0)
 		}()
 	}
 
 	if hnswEnabled {
-		hnswGraph = graph.New(&graph.Configuration{
+		hnswCfg := &graph.Configuration{
 			Dim:            dim,
 			M:              M, // original value is 16
 			EFConstruction: 50,
 			EF:             200,
 			MaxElements:    maxElements,
+			GrowthFactor:   1.5,
 			SpaceType:      graph.SpaceTypeCosine,
-		})
+			OnResize: func(oldMaxElements, newMaxElements uint32) {
+				logger.Info("hnsw index resized", zap.Uint32("from", oldMaxElements), zap.Uint32("to", newMaxElements))
+			},
+			RecallSampleRate: *recallRate,
+			OnTune: func(r graph.TuneResult) {
+				logger.Info("hnsw ef tuned", zap.Int("ef", r.EF), zap.Float64("recall", r.Recall), zap.Duration("p99", r.P99), zap.Bool("met", r.Met))
+			},
+		}
+		if *tuneRecall > 0 {
+			hnswCfg.Tune = &graph.TuneTarget{Recall: *tuneRecall}
+		}
+
+		var err error
+		if *snapshotDir != "" {
+			hnswGraph, err = graph.Load(*snapshotDir, hnswCfg)
+			if err != nil {
+				logger.Error("hnsw snapshot load failed", zap.Error(err), zap.String("dir", *snapshotDir))
+			}
+		}
+		if hnswGraph == nil {
+			hnswGraph, err = graph.New(hnswCfg)
+			if err != nil {
+				logger.Fatal("hnsw graph init failed", zap.Error(err))
+			}
+		}
 	}
 
 	inMemoryGraph = inmemory.New(&inmemory.Configuration{
@@ -99,6 +138,11 @@ func main() {
 		SpaceType:   graph.SpaceTypeCosine,
 	})
 
+	vectorIndex = inMemoryGraph
+	if hnswEnabled {
+		vectorIndex = hnswGraph
+	}
+
 	go runGraph()
 
 	e := echo.New()
@@ -112,6 +156,50 @@ func main() {
 	e.GET("/list-ids", func(c echo.Context) error {
 		return c.JSON(http.StatusOK, inMemoryGraph.ListIDs())
 	})
+	e.GET("/recall", func(c echo.Context) error {
+		if !hnswEnabled {
+			return c.String(http.StatusBadRequest, "recall is only measured for the hnsw backend")
+		}
+		return c.JSON(http.StatusOK, hnswGraph.RecallStats())
+	})
+	e.GET("/ef", func(c echo.Context) error {
+		if !hnswEnabled {
+			return c.String(http.StatusBadRequest, "ef is only tuned for the hnsw backend")
+		}
+		result, ok := hnswGraph.TunedEF()
+		if !ok {
+			return c.String(http.StatusNotFound, "ef not tuned yet")
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+	e.GET("/snapshot", func(c echo.Context) error {
+		if !hnswEnabled {
+			return c.String(http.StatusBadRequest, "snapshots are only taken of the hnsw backend")
+		}
+		opts := graph.StreamOptions{}
+		switch c.QueryParam("compression") {
+		case "":
+		case "gzip":
+			opts.Compression = graph.CompressionGzip
+		case "zstd":
+			opts.Compression = graph.CompressionZstd
+		default:
+			return c.String(http.StatusBadRequest, "compression must be gzip or zstd")
+		}
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+		c.Response().WriteHeader(http.StatusOK)
+		if _, err := hnswGraph.WriteToWithOptions(c.Response(), opts); err != nil {
+			logger.Error("hnsw snapshot stream failed", zap.Error(err))
+		}
+		return nil
+	})
+	e.GET("/vectors/:id", func(c echo.Context) error {
+		vector, ok := vectorIndex.Get(c.Param("id"))
+		if !ok {
+			return c.String(http.StatusNotFound, "id not found")
+		}
+		return c.JSON(http.StatusOK, vector)
+	})
 	e.POST("/search", func(c echo.Context) error {
 		vectorStr := c.FormValue("vector")
 		if vectorStr == "" {
@@ -125,76 +213,133 @@ func main() {
 			return c.String(http.StatusBadRequest, "vector must be valid json")
 		}
 
-		resultsNum := 100
+		params, err := parseSearchParams(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
 
-		resultsStr := c.FormValue("results")
-		if resultsStr != "" {
-			var err error
-			resultsNum, err = strconv.Atoi(resultsStr)
-			if err != nil {
-				return c.String(http.StatusBadRequest, "results must be a number")
-			}
+		if len(vector) == 0 && len(params.options.Contains) == 0 && params.options.Query == nil {
+			return c.String(http.StatusBadRequest, "vector, exact or q must be set")
+		}
+		// an empty vector ranks the exact terms by BM25
+		if len(vector) != 0 && len(vector) != dim {
+			return c.String(http.StatusBadRequest, "vector must be "+strconv.Itoa(dim)+"-dimensional")
 		}
 
-		exactStr := c.FormValue("exact")
-		var exact []string
-		if exactStr != "" {
-			err = json.Unmarshal([]byte(exactStr), &exact)
+		if params.hybrid != nil {
+			// the exact terms are ranked along with the vector instead of filtering
+			text := bytes.Join(params.options.Contains, []byte(" "))
+			params.options.Contains = nil
+			params.hybrid.Search = params.options
+
+			results, err := hybrid.Search(inMemoryGraph, params.index(), text, vector, params.resultsNum, *params.hybrid)
 			if err != nil {
-				logger.Error("exact must be valid json", zap.Error(err), zap.String("exact", exactStr))
-				return c.String(http.StatusBadRequest, "exact must be valid json")
+				logger.Error("hybrid search failed", zap.Error(err))
+				return c.String(http.StatusInternalServerError, "search failed")
 			}
+			return c.JSON(http.StatusOK, results)
 		}
 
-		maxDistanceStr := c.FormValue("maxDistance")
-		var maxDistance float32 = defaultMaxDistance
-		if maxDistanceStr != "" {
-			newMaxDistance, err := strconv.ParseFloat(maxDistanceStr, 32)
-			if err != nil {
-				logger.Error("maxDistance must be a number", zap.Error(err), zap.String("maxDistance", maxDistanceStr))
-				return c.String(http.StatusBadRequest, "defaultMaxDistance must be a number")
-			}
-			maxDistance = float32(newMaxDistance)
+		results, err := params.index().SearchWithOptions(vector, params.resultsNum, params.options)
+		if err != nil {
+			logger.Error("search failed", zap.Error(err))
+			return c.String(http.StatusInternalServerError, "search failed")
+		}
+		if len(vector) == 0 {
+			// the distance limits bound vector distances
+			return params.respondAll(c, results)
 		}
 
-		minDistanceStr := c.FormValue("minDistance")
-		var minDistance float32 = defaultMinDistance
-		if minDistanceStr != "" {
-			newMinDistance, err := strconv.ParseFloat(minDistanceStr, 32)
+		return params.respond(c, results)
+	})
+	e.POST("/search-radius", func(c echo.Context) error {
+		var vector []float32
+		err := json.Unmarshal([]byte(c.FormValue("vector")), &vector)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "vector must be valid json")
+		}
+		if len(vector) != dim {
+			return c.String(http.StatusBadRequest, "vector must be "+strconv.Itoa(dim)+"-dimensional")
+		}
+
+		radius, err := strconv.ParseFloat(c.FormValue("radius"), 32)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "radius must be a number")
+		}
+
+		limit := 0
+		limitStr := c.FormValue("limit")
+		if limitStr != "" {
+			limit, err = strconv.Atoi(limitStr)
 			if err != nil {
-				logger.Error("minDistance must be a number", zap.Error(err), zap.String("minDistance", minDistanceStr))
-				return c.String(http.StatusBadRequest, "minDistance must be a number")
+				return c.String(http.StatusBadRequest, "limit must be a number")
 			}
-			minDistance = float32(newMinDistance)
 		}
 
-		filterCategory := c.FormValue("category")
+		results, err := vectorIndex.SearchRadius(vector, float32(radius), limit)
+		if err != nil {
+			logger.Error("radius search failed", zap.Error(err))
+			return c.String(http.StatusInternalServerError, "search failed")
+		}
 
-		if len(vector) == 0 && len(exact) == 0 {
-			return c.String(http.StatusBadRequest, "vector or exact must be set")
+		return c.JSON(http.StatusOK, results)
+	})
+	e.POST("/search-batch", func(c echo.Context) error {
+		if !hnswEnabled {
+			return c.String(http.StatusBadRequest, "batch search needs the hnsw backend")
 		}
-		if len(vector) != dim {
-			return c.String(http.StatusBadRequest, "vector must be "+strconv.Itoa(dim)+"-dimensional")
+
+		var vectors [][]float32
+		err := json.Unmarshal([]byte(c.FormValue("vectors")), &vectors)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "vectors must be valid json")
 		}
 
-		if len(exact) > 0 || !hnswEnabled {
-			contains := make([][]byte, len(exact))
-			for i, e := range exact {
-				contains[i] = []byte(e)
-			}
-			return c.JSON(http.StatusOK, filterResults(inMemoryGraph.Search(contains, vector, resultsNum), filterCategory))
+		params, err := parseSearchParams(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
 		}
 
-		// fmt.Println("searching hnsw")
+		if params.options.Where != nil || len(params.options.Contains) > 0 || params.options.Query != nil {
+			return c.String(http.StatusBadRequest, "batch search does not support filters")
+		}
+		if params.options.EF > 0 || params.hybrid != nil {
+			return c.String(http.StatusBadRequest, "batch search does not support ef or fusion")
+		}
 
-		results := hnswGraph.Search(vector, resultsNum)
-		for key, distance := range results {
-			if distance > maxDistance || distance < minDistance {
-				delete(results, key)
-			}
+		batch, err := hnswGraph.SearchBatch(vectors, params.resultsNum)
+		if errors.Is(err, graph.ErrDimensionMismatch) {
+			return c.String(http.StatusBadRequest, "vectors must be "+strconv.Itoa(dim)+"-dimensional")
+		} else if err != nil {
+			logger.Error("batch search failed", zap.Error(err))
+			return c.String(http.StatusInternalServerError, "search failed")
 		}
 
-		return c.JSON(http.StatusOK, filterResults(results, filterCategory))
+		for i, results := range batch {
+			batch[i] = filterDistance(results, params.minDistance, params.maxDistance)
+		}
+		return c.JSON(http.StatusOK, batch)
+	})
+	e.POST("/search-by-id", func(c echo.Context) error {
+		id := c.FormValue("id")
+		if id == "" {
+			return c.String(http.StatusBadRequest, "id must be set")
+		}
+
+		params, err := parseSearchParams(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		results, err := params.index().SearchByID(id, params.resultsNum, params.options)
+		if errors.Is(err, graph.ErrUnknownLabel) {
+			return c.String(http.StatusNotFound, "id not found")
+		} else if err != nil {
+			logger.Error("search by id failed", zap.Error(err))
+			return c.String(http.StatusInternalServerError, "search failed")
+		}
+
+		return params.respond(c, results)
 	})
 	e.Logger.Fatal(e.Start("0.0.0.0:8080"))
 }
@@ -213,11 +358,6 @@ func runGraph() {
 			defer wg.Done()
 
 			for c := range ch {
-				if curr := counter.Load(); curr > maxElements-10 {
-					logger.Error("too many elements", zap.Int64("elements", curr))
-					continue
-				}
-
 				if c.Vector == nil && c.VectorDB == "" {
 					continue
 				} else if c.Vector != nil {
@@ -266,18 +406,32 @@ func putPost(sp *model.Article) error {
 	hashid := setup.ArticleHashID.Encode(sp.ID)
 
 	vector := reduceFloat(sp.Vector)
+	md := graph.WithMetadata(articleMetadata(sp))
 
 	if hnswEnabled {
-		hnswGraph.Put(hashid, vector)
+		if err := hnswGraph.Put(hashid, vector, md); err != nil {
+			return err
+		}
 	}
 
-	inMemoryGraph.Put(hashid, bytes.ToLower([]byte(sp.Title+" "+sp.Summary)), vector)
-
-	putLabels(hashid, sp.Categories)
+	if err := inMemoryGraph.Put(hashid, bytes.ToLower([]byte(sp.Title+" "+sp.Summary)), vector, md); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+func articleMetadata(sp *model.Article) *metadata.Metadata {
+	md := &metadata.Metadata{}
+	if len(sp.Categories) > 0 {
+		md.Tags = map[string][]string{"category": sp.Categories}
+	}
+	if sp.PublishDate != nil {
+		md.Times = map[string]time.Time{"published_at": *sp.PublishDate}
+	}
+	return md
+}
+
 func reduceFloat(v []float64) []float32 {
 	var result = make([]float32, len(v))
 	for i, f := range v {
@@ -313,44 +467,177 @@ func startGraphLoader(ch chan *model.Article) {
 	}
 }
 
-func putLabels(post string, labels []string) {
-	if len(labels) == 0 {
-		return
+func filterDistance(results []graph.Result, minDistance, maxDistance float32) []graph.Result {
+	filtered := results[:0]
+	for _, r := range results {
+		if r.Distance <= maxDistance && r.Distance >= minDistance {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
+
+type searchParams struct {
+	resultsNum  int
+	minDistance float32
+	maxDistance float32
+	ranked      bool
+	options     graph.SearchOptions
+	// hybrid is set when the search fuses the exact terms with the vector.
+	hybrid *hybrid.Options
+}
+
+// parseSearchParams reads the form values shared by the search endpoints.
+func parseSearchParams(c echo.Context) (*searchParams, error) {
+	params := &searchParams{
+		resultsNum:  100,
+		minDistance: defaultMinDistance,
+		maxDistance: defaultMaxDistance,
+		ranked:      c.FormValue("ranked") == "true",
+	}
+
+	resultsStr := c.FormValue("results")
+	if resultsStr != "" {
+		var err error
+		params.resultsNum, err = strconv.Atoi(resultsStr)
+		if err != nil {
+			return nil, errors.New("results must be a number")
+		}
+	}
+
+	exactStr := c.FormValue("exact")
+	if exactStr != "" {
+		var exact []string
+		err := json.Unmarshal([]byte(exactStr), &exact)
+		if err != nil {
+			logger.Error("exact must be valid json", zap.Error(err), zap.String("exact", exactStr))
+			return nil, errors.New("exact must be valid json")
+		}
+		params.options.Contains = make([][]byte, len(exact))
+		for i, e := range exact {
+			params.options.Contains[i] = []byte(e)
+		}
+	}
+
+	maxDistanceStr := c.FormValue("maxDistance")
+	if maxDistanceStr != "" {
+		newMaxDistance, err := strconv.ParseFloat(maxDistanceStr, 32)
+		if err != nil {
+			logger.Error("maxDistance must be a number", zap.Error(err), zap.String("maxDistance", maxDistanceStr))
+			return nil, errors.New("maxDistance must be a number")
+		}
+		params.maxDistance = float32(newMaxDistance)
 	}
 
-	newLabels := make(map[string]struct{})
-	for _, label := range labels {
-		newLabels[label] = struct{}{}
+	minDistanceStr := c.FormValue("minDistance")
+	if minDistanceStr != "" {
+		newMinDistance, err := strconv.ParseFloat(minDistanceStr, 32)
+		if err != nil {
+			logger.Error("minDistance must be a number", zap.Error(err), zap.String("minDistance", minDistanceStr))
+			return nil, errors.New("minDistance must be a number")
+		}
+		params.minDistance = float32(newMinDistance)
 	}
 
-	postLabelsMtx.Lock()
-	defer postLabelsMtx.Unlock()
+	efStr := c.FormValue("ef")
+	if efStr != "" {
+		var err error
+		params.options.EF, err = strconv.Atoi(efStr)
+		if err != nil {
+			return nil, errors.New("ef must be a number")
+		}
+	}
+
+	if q := c.FormValue("q"); q != "" {
+		var err error
+		params.options.Query, err = query.Parse(q)
+		if err != nil {
+			return nil, fmt.Errorf("q: %w", err)
+		}
+	}
+
+	if fusion := c.FormValue("fusion"); fusion != "" {
+		var err error
+		params.hybrid, err = parseHybridOptions(fusion, c.FormValue("textWeight"), c.FormValue("vectorWeight"))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	postLabels[post] = newLabels
+	where, err := searchWhere(c.FormValue("category"), c.FormValue("where"))
+	if err != nil {
+		return nil, fmt.Errorf("where: %w", err)
+	}
+	params.options.Where = where
+
+	return params, nil
 }
 
-func filterResults(results map[string]float32, label string) map[string]float32 {
-	if label == "" {
-		return results
+func parseHybridOptions(fusion, textWeight, vectorWeight string) (*hybrid.Options, error) {
+	opts := &hybrid.Options{}
+	switch fusion {
+	case "rrf":
+		opts.Fusion = hybrid.FusionRRF
+	case "linear":
+		opts.Fusion = hybrid.FusionLinear
+	default:
+		return nil, errors.New("fusion must be rrf or linear")
 	}
 
-	filtered := make(map[string]float32, len(results))
-	for post, value := range results {
-		if postHasLabel(post, label) {
-			filtered[post] = value
+	for _, w := range []struct {
+		value  string
+		weight *float32
+		name   string
+	}{
+		{textWeight, &opts.TextWeight, "textWeight"},
+		{vectorWeight, &opts.VectorWeight, "vectorWeight"},
+	} {
+		if w.value == "" {
+			continue
 		}
+		weight, err := strconv.ParseFloat(w.value, 32)
+		if err != nil || weight < 0 {
+			return nil, errors.New(w.name + " must be a non-negative number")
+		}
+		*w.weight = float32(weight)
 	}
-	return filtered
+
+	return opts, nil
+}
+
+func (p *searchParams) index() index.Index {
+	if len(p.options.Contains) > 0 || p.options.Query != nil {
+		// only the in-memory backend stores text
+		return inMemoryGraph
+	}
+	return vectorIndex
 }
 
-func postHasLabel(post, label string) bool {
-	postLabelsMtx.RLock()
-	defer postLabelsMtx.RUnlock()
+func (p *searchParams) respond(c echo.Context, results []graph.Result) error {
+	return p.respondAll(c, filterDistance(results, p.minDistance, p.maxDistance))
+}
 
-	if labels, ok := postLabels[post]; ok {
-		_, ok2 := labels[label]
-		return ok2
+// respondAll responds with results whatever their distance.
+func (p *searchParams) respondAll(c echo.Context, results []graph.Result) error {
+	if p.ranked {
+		return c.JSON(http.StatusOK, results)
 	}
+	return c.JSON(http.StatusOK, graph.ResultsToMap(results))
+}
 
-	return false
+// searchWhere builds the metadata filter from the category shorthand and the
+// where expression.
+func searchWhere(category, where string) (metadata.Expr, error) {
+	var exprs []metadata.Expr
+	if category != "" {
+		exprs = append(exprs, metadata.TagEquals("category", category))
+	}
+	if where != "" {
+		expr, err := metadata.Parse(where)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	return metadata.And(exprs...), nil
 }
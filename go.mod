@@ -40,6 +40,7 @@ replace (
 require (
 	github.com/abilitylab/logger v0.0.0-20210528213912-463096452f39
 	github.com/chewxy/math32 v1.10.1
+	github.com/klauspost/compress v1.17.4
 	github.com/labstack/echo/v4 v4.8.0
 	github.com/stretchr/testify v1.8.0
 	go.uber.org/atomic v1.9.0
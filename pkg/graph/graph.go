@@ -1,10 +1,16 @@
 package graph
 
 import (
+	"errors"
+	"hash/fnv"
+	"io"
 	"log"
+	"sort"
 	"sync"
 
 	hnswgo "github.com/abilitylab/graph/pkg/hnsw"
+	"github.com/abilitylab/graph/pkg/metadata"
+	"github.com/abilitylab/graph/pkg/query"
 )
 
 type SpaceType string
@@ -15,41 +21,232 @@ const (
 	SpaceTypeL2     SpaceType = "l2"
 )
 
+// Sentinel errors returned by Service. They match hnswgo errors with the same
+// meaning under errors.Is.
+var (
+	ErrDimensionMismatch = hnswgo.ErrDimensionMismatch
+	ErrCapacityExceeded  = hnswgo.ErrCapacityExceeded
+	ErrUnknownLabel      = hnswgo.ErrUnknownLabel
+	ErrIO                = hnswgo.ErrIO
+)
+
+var (
+	ErrUnsupportedOption = errors.New("graph: search option not supported by this backend")
+	ErrBatchLength       = errors.New("graph: batch ids and vectors differ in length")
+)
+
+const (
+	defaultMaxElements  = 1024
+	defaultGrowthFactor = 1.5
+	defaultEF           = 10
+	defaultSeed         = 100
+
+	defaultFilterBruteForceRatio = 0.01
+
+	radiusSearchInitialK = 16
+)
+
 type Configuration struct {
 	Dim            int
 	M              int
 	EFConstruction int
 	EF             int
-	MaxElements    uint32
-	SpaceType      SpaceType
+	// MaxElements is the initial capacity of the index. Put grows the index
+	// by GrowthFactor whenever it fills up.
+	MaxElements  uint32
+	GrowthFactor float64
+	SpaceType    SpaceType
+	// OnResize is called after the index has grown. When nil, resizes are
+	// logged.
+	OnResize func(oldMaxElements, newMaxElements uint32)
+	// FilterBruteForceRatio is the share of stored points a filter may allow
+	// for filtered searches to skip the graph and compare against every
+	// allowed point instead. Zero means 0.01, a negative value disables it.
+	FilterBruteForceRatio float64
+	// Threads is the number of native threads PutBatch and SearchBatch use.
+	// Zero means one per core.
+	Threads int
+	// Exact replaces the hnsw graph with an exhaustive scan. M,
+	// EFConstruction and EF are ignored.
+	Exact bool
+	// RecallSampleRate is the share of unfiltered searches rerun exactly in
+	// the background to measure recall, see RecallStats. Zero disables
+	// sampling.
+	RecallSampleRate float64
+	// Tune, when set, has the service pick its ef with TuneEF once it holds
+	// 1000 points and again each time it grows by RetuneGrowth since.
+	Tune *TuneTarget
+	// RetuneGrowth is the growth, as a fraction of the size at the last
+	// tuning, that triggers the next one. Zero means 0.2.
+	RetuneGrowth float64
+	// OnTune is called after each automatic tuning. When nil, tunings are
+	// logged.
+	OnTune func(TuneResult)
+	// Seed seeds the level draws of the hnsw graph. Zero means 100. hnswlib
+	// does not store it: a loaded graph draws levels from a fixed seed.
+	Seed int
+	// Deterministic applies writes one at a time, in call and batch order,
+	// so that the same writes with the same Seed build identical snapshots.
+	// Leave Tune unset for this: it changes the stored ef.
+	Deterministic bool
+}
+
+// index is the part of hnswgo.HNSW the service uses; hnswgo.Bruteforce
+// implements it too.
+type index interface {
+	AddPoint(vector []float32, label uint32) error
+	AddPoints(vectors [][]float32, labels []uint32, threads int) ([]hnswgo.ErrorCode, error)
+	SearchKNN(vector []float32, N int) ([]uint32, []float32, error)
+	SearchKNNWithEf(vector []float32, N int, ef int) ([]uint32, []float32, error)
+	SearchKNNFiltered(vector []float32, N int, ef int, allow hnswgo.Bitset) ([]uint32, []float32, error)
+	SearchKNNAmong(vector []float32, N int, candidates []uint32) ([]uint32, []float32, error)
+	SearchKNNExact(vector []float32, N int) ([]uint32, []float32, error)
+	SearchKNNBatch(vectors [][]float32, N int, threads int) ([][]uint32, [][]float32, error)
+	SetEf(ef int)
+	MarkDelete(label uint32) error
+	Resize(maxElements uint32) error
+	MaxElements() uint32
+	Len() uint32
+	GetDataByLabel(label uint32) ([]float32, error)
+	Save(location string) error
+	WriteTo(w io.Writer) (int64, error)
+	Free()
 }
 
 type Service struct {
-	dim           int
-	h             *hnswgo.HNSW
-	nextIndex     uint32
-	labelInnerMap map[string]uint32
-	labelOuterMap map[uint32]string
-	rwMtx         sync.RWMutex
+	dim            int
+	m              int
+	efConstruction int
+	ef             int
+	spaceType      SpaceType
+	exact          bool
+	h              index
+	nextIndex      uint32
+	labelInnerMap  map[string]uint32
+	labelOuterMap  map[uint32]string
+	metadata       map[uint32]*metadata.Metadata
+	growthFactor   float64
+	onResize       func(oldMaxElements, newMaxElements uint32)
+
+	filterBruteForceRatio float64
+	threads               int
+	deterministic         bool
+	recall                recallMonitor
+	tune                  tuner
+
+	// rwMtx guards the label maps, nextIndex and metadata; searches release it
+	// while in h. indexMtx is held shared around calls into h, exclusively to
+	// resize h or set its ef.
+	// writeMtx is held shared by writes, exclusively by Save and by writes in
+	// deterministic mode. labelMtx serializes writes to the same ID.
+	// Lock order: writeMtx, labelMtx, rwMtx, indexMtx.
+	rwMtx    sync.RWMutex
+	indexMtx sync.RWMutex
+	writeMtx sync.RWMutex
+	labelMtx [labelLockStripes]sync.Mutex
 }
 
-func New(cfg *Configuration) *Service {
-	h := hnswgo.New(
-		cfg.Dim,
-		cfg.M,
-		cfg.EFConstruction,
-		100,
-		cfg.MaxElements,
-		string(cfg.SpaceType))
+const labelLockStripes = 256
+
+func New(cfg *Configuration) (*Service, error) {
+	maxElements := cfg.MaxElements
+	if maxElements == 0 {
+		maxElements = defaultMaxElements
+	}
+
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = defaultSeed
+	}
 
-	return &Service{
-		dim:           cfg.Dim,
-		h:             h,
-		nextIndex:     0,
-		labelInnerMap: make(map[string]uint32, cfg.MaxElements),
-		labelOuterMap: make(map[uint32]string, cfg.MaxElements),
-		rwMtx:         sync.RWMutex{},
+	var (
+		h   index
+		err error
+	)
+	if cfg.Exact {
+		h, err = hnswgo.NewBruteforce(cfg.Dim, maxElements, string(cfg.SpaceType))
+	} else {
+		h, err = hnswgo.New(
+			cfg.Dim,
+			cfg.M,
+			cfg.EFConstruction,
+			seed,
+			maxElements,
+			string(cfg.SpaceType))
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := newService(cfg, h)
+	s.labelInnerMap = make(map[string]uint32, maxElements)
+	s.labelOuterMap = make(map[uint32]string, maxElements)
+
+	return s, nil
+}
+
+func newService(cfg *Configuration, h index) *Service {
+	growthFactor := cfg.GrowthFactor
+	if growthFactor <= 1 {
+		growthFactor = defaultGrowthFactor
+	}
+
+	onResize := cfg.OnResize
+	if onResize == nil {
+		onResize = logResize
+	}
+
+	filterBruteForceRatio := cfg.FilterBruteForceRatio
+	if filterBruteForceRatio == 0 {
+		filterBruteForceRatio = defaultFilterBruteForceRatio
+	}
+
+	s := &Service{
+		dim:            cfg.Dim,
+		m:              cfg.M,
+		efConstruction: cfg.EFConstruction,
+		spaceType:      cfg.SpaceType,
+		exact:          cfg.Exact,
+		h:              h,
+		nextIndex:      0,
+		metadata:       make(map[uint32]*metadata.Metadata),
+		growthFactor:   growthFactor,
+		onResize:       onResize,
+
+		filterBruteForceRatio: filterBruteForceRatio,
+		threads:               cfg.Threads,
+		deterministic:         cfg.Deterministic,
+		recall: recallMonitor{
+			rate: cfg.RecallSampleRate,
+			busy: make(chan struct{}, 1),
+		},
+	}
+
+	s.tune = tuner{
+		target: cfg.Tune,
+		growth: cfg.RetuneGrowth,
+		onTune: cfg.OnTune,
+		busy:   make(chan struct{}, 1),
+		next:   autoTuneMinPoints,
+	}
+	if s.tune.growth <= 0 {
+		s.tune.growth = defaultRetuneGrowth
+	}
+	if s.tune.onTune == nil {
+		s.tune.onTune = logTune
+	}
+
+	ef := cfg.EF
+	if ef <= 0 {
+		ef = defaultEF
+	}
+	s.SetEF(ef)
+
+	return s
+}
+
+func logResize(oldMaxElements, newMaxElements uint32) {
+	log.Printf("graph: index resized from %d to %d elements", oldMaxElements, newMaxElements)
 }
 
 func (s *Service) findInnerLabel(outerLabel string) (uint32, bool) {
@@ -86,28 +283,286 @@ func (s *Service) createNewLabelUnSafe(outerLabel string) uint32 {
 	return innerLabel
 }
 
+func (s *Service) deleteLabelUnsafe(outerLabel string, innerLabel uint32) {
+	delete(s.labelInnerMap, outerLabel)
+	delete(s.labelOuterMap, innerLabel)
+	delete(s.metadata, innerLabel)
+}
+
+func (s *Service) labelLock(outerLabel string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(outerLabel))
+	return &s.labelMtx[hash.Sum32()%labelLockStripes]
+}
+
+// lockLabels locks the labelMtx stripes of every outerLabel in a fixed order
+// and returns the function unlocking them.
+func (s *Service) lockLabels(outerLabels []string) func() {
+	stripes := make(map[*sync.Mutex]struct{}, len(outerLabels))
+	for _, outerLabel := range outerLabels {
+		stripes[s.labelLock(outerLabel)] = struct{}{}
+	}
+
+	locked := make([]*sync.Mutex, 0, len(stripes))
+	for i := range s.labelMtx {
+		if _, found := stripes[&s.labelMtx[i]]; found {
+			s.labelMtx[i].Lock()
+			locked = append(locked, &s.labelMtx[i])
+		}
+	}
+
+	return func() {
+		for _, mtx := range locked {
+			mtx.Unlock()
+		}
+	}
+}
+
+// lockIndexFor locks indexMtx for adding n points labeled up to innerLabel,
+// growing h first when needed, and returns the unlock function.
+//
+// The hnsw graph keeps a slot for every inner label it has seen, deleted or
+// not, and inner labels are never reused, so there is room for innerLabel once
+// MaxElements exceeds it; inserts then run concurrently. The exact index
+// frees the slot of a deleted point and is sized on its live points instead;
+// its writes are exclusive anyway, so indexMtx is held exclusively to keep the
+// count from changing under the check.
+func (s *Service) lockIndexFor(innerLabel uint32, n int) (func(), error) {
+	for s.exact {
+		s.indexMtx.Lock()
+		size := s.h.Len() + uint32(n)
+		oldMaxElements := s.h.MaxElements()
+		if size <= oldMaxElements {
+			return s.indexMtx.Unlock, nil
+		}
+		newMaxElements, err := s.resizeUnsafe(size)
+		s.indexMtx.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		s.onResize(oldMaxElements, newMaxElements)
+	}
+
+	s.indexMtx.RLock()
+	for s.h.MaxElements() <= innerLabel {
+		s.indexMtx.RUnlock()
+		if err := s.grow(innerLabel + 1); err != nil {
+			return nil, err
+		}
+		s.indexMtx.RLock()
+	}
+	return s.indexMtx.RUnlock, nil
+}
+
+// addPoint inserts vector into h, growing h first when needed.
+func (s *Service) addPoint(vector []float32, innerLabel uint32) error {
+	unlock, err := s.lockIndexFor(innerLabel, 1)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return s.h.AddPoint(vector, innerLabel)
+}
+
+// grow resizes h to hold size points. Resizing reallocates hnswlib's memory,
+// so it waits for every running insert and search to finish.
+func (s *Service) grow(size uint32) error {
+	s.indexMtx.Lock()
+
+	oldMaxElements := s.h.MaxElements()
+	if oldMaxElements >= size {
+		s.indexMtx.Unlock()
+		return nil
+	}
+
+	newMaxElements, err := s.resizeUnsafe(size)
+	s.indexMtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.onResize(oldMaxElements, newMaxElements)
+
+	return nil
+}
+
+// resizeUnsafe grows h by growthFactor, or more when size needs it. The
+// caller holds indexMtx exclusively.
+func (s *Service) resizeUnsafe(size uint32) (uint32, error) {
+	newMaxElements := uint32(float64(s.h.MaxElements()) * s.growthFactor)
+	if newMaxElements < size {
+		newMaxElements = size
+	}
+	return newMaxElements, s.h.Resize(newMaxElements)
+}
+
+// lockWrite takes writeMtx for a write and returns the function releasing
+// it.
+func (s *Service) lockWrite() func() {
+	if s.deterministic {
+		s.writeMtx.Lock()
+		return s.writeMtx.Unlock
+	}
+	s.writeMtx.RLock()
+	return s.writeMtx.RUnlock
+}
+
 func (s *Service) SetEF(ef int) {
+	s.indexMtx.Lock()
+	defer s.indexMtx.Unlock()
+
+	s.ef = ef
 	s.h.SetEf(ef)
 }
 
-func (s *Service) Put(outerLabel string, vector []float32) {
+// PutOptions holds what PutOption functions set.
+type PutOptions struct {
+	// Metadata replaces the payload stored with the vector. Without it, Put
+	// keeps the payload already stored.
+	Metadata *metadata.Metadata
+}
+
+type PutOption func(*PutOptions)
+
+// WithMetadata attaches md to the stored vector. It is returned in search
+// results and matched by SearchOptions.Where.
+func WithMetadata(md *metadata.Metadata) PutOption {
+	return func(o *PutOptions) {
+		o.Metadata = md
+	}
+}
+
+// ApplyPutOptions folds opts into a PutOptions value.
+func ApplyPutOptions(opts []PutOption) PutOptions {
+	var o PutOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (s *Service) Put(outerLabel string, vector []float32, opts ...PutOption) error {
 	if len(vector) != s.dim {
-		panic("put: vector length is not equal to dim")
+		return ErrDimensionMismatch
 	}
 
-	s.rwMtx.Lock()
-	defer s.rwMtx.Unlock()
+	o := ApplyPutOptions(opts)
+
+	defer s.lockWrite()()
+
+	labelMtx := s.labelLock(outerLabel)
+	labelMtx.Lock()
+	defer labelMtx.Unlock()
 
+	s.rwMtx.Lock()
 	innerLabel, found := s.findInnerLabelUnsafe(outerLabel)
 	if !found {
 		innerLabel = s.createNewLabelUnSafe(outerLabel)
 	}
+	s.rwMtx.Unlock()
+
+	// the graph insertion runs unlocked, next to other inserts and searches
+	err := s.addPoint(vector, innerLabel)
+
+	s.rwMtx.Lock()
+	defer s.rwMtx.Unlock()
 
-	// fmt.Println("put: adding outerLabel:", outerLabel)
+	if err != nil {
+		if !found {
+			s.deleteLabelUnsafe(outerLabel, innerLabel)
+		}
+		return err
+	}
 
-	s.h.AddPoint(vector, innerLabel)
+	if o.Metadata != nil {
+		s.metadata[innerLabel] = o.Metadata
+	}
+
+	s.maybeRetuneUnsafe()
+
+	return nil
+}
+
+// PutBatch is Put for many vectors, inserted by Threads native threads in a
+// single call into hnswlib. When an ID appears more than once, its last vector
+// wins. On error some vectors may have been stored; the failed ones are not.
+func (s *Service) PutBatch(outerLabels []string, vectors [][]float32) error {
+	if len(outerLabels) != len(vectors) {
+		return ErrBatchLength
+	}
+	for _, vector := range vectors {
+		if len(vector) != s.dim {
+			return ErrDimensionMismatch
+		}
+	}
+
+	last := make(map[string]int, len(outerLabels))
+	for i, outerLabel := range outerLabels {
+		last[outerLabel] = i
+	}
+	if len(last) < len(outerLabels) {
+		dedupLabels := make([]string, 0, len(last))
+		dedupVectors := make([][]float32, 0, len(last))
+		for i, outerLabel := range outerLabels {
+			if last[outerLabel] == i {
+				dedupLabels = append(dedupLabels, outerLabel)
+				dedupVectors = append(dedupVectors, vectors[i])
+			}
+		}
+		outerLabels, vectors = dedupLabels, dedupVectors
+	}
+	if len(outerLabels) == 0 {
+		return nil
+	}
+
+	defer s.lockWrite()()
+
+	defer s.lockLabels(outerLabels)()
+
+	innerLabels := make([]uint32, len(outerLabels))
+	found := make([]bool, len(outerLabels))
+	var maxInnerLabel uint32
+
+	s.rwMtx.Lock()
+	for i, outerLabel := range outerLabels {
+		innerLabels[i], found[i] = s.findInnerLabelUnsafe(outerLabel)
+		if !found[i] {
+			innerLabels[i] = s.createNewLabelUnSafe(outerLabel)
+		}
+		if innerLabels[i] > maxInnerLabel {
+			maxInnerLabel = innerLabels[i]
+		}
+	}
+	s.rwMtx.Unlock()
+
+	var codes []hnswgo.ErrorCode
+	unlock, err := s.lockIndexFor(maxInnerLabel, len(vectors))
+	if err == nil {
+		threads := s.threads
+		if s.deterministic {
+			threads = 1
+		}
+		codes, err = s.h.AddPoints(vectors, innerLabels, threads)
+		unlock()
+	}
+	if err == nil {
+		s.rwMtx.RLock()
+		s.maybeRetuneUnsafe()
+		s.rwMtx.RUnlock()
+		return nil
+	}
+
+	s.rwMtx.Lock()
+	defer s.rwMtx.Unlock()
+
+	for i, outerLabel := range outerLabels {
+		if !found[i] && (codes == nil || codes[i] != 0) {
+			s.deleteLabelUnsafe(outerLabel, innerLabels[i])
+		}
+	}
 
-	// fmt.Println("put: added outerLabel:", outerLabel)
+	return err
 }
 
 func (s *Service) ListIDs() []string {
@@ -124,34 +579,362 @@ func (s *Service) ListIDs() []string {
 }
 
 func (s *Service) IndexesLoaded() uint32 {
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
 	return s.nextIndex
 }
 
-func (s *Service) Delete(outerLabel string) {
-	panic("not implemented")
+// Upsert is Put under the name used by the index.Index interface.
+func (s *Service) Upsert(outerLabel string, vector []float32, opts ...PutOption) error {
+	return s.Put(outerLabel, vector, opts...)
 }
 
-func (s *Service) Search(vectors []float32, resultsNum int) map[string]float32 {
+// Metadata returns the payload stored under outerLabel, nil when it has none.
+func (s *Service) Metadata(outerLabel string) (*metadata.Metadata, bool) {
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	innerLabel, found := s.findInnerLabelUnsafe(outerLabel)
+	if !found {
+		return nil, false
+	}
+
+	return s.metadata[innerLabel], true
+}
+
+// Get returns the vector stored under outerLabel. Cosine indexes store and
+// therefore return normalized vectors.
+func (s *Service) Get(outerLabel string) ([]float32, bool) {
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	innerLabel, found := s.findInnerLabelUnsafe(outerLabel)
+	if !found {
+		return nil, false
+	}
+
+	s.indexMtx.RLock()
+	defer s.indexMtx.RUnlock()
+
+	vector, err := s.h.GetDataByLabel(innerLabel)
+	if err != nil {
+		return nil, false
+	}
+
+	return vector, true
+}
+
+// GetMany is Get for several IDs at once. IDs that are not stored are left out
+// of the returned map.
+func (s *Service) GetMany(outerLabels []string) map[string][]float32 {
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	s.indexMtx.RLock()
+	defer s.indexMtx.RUnlock()
+
+	out := make(map[string][]float32, len(outerLabels))
+	for _, outerLabel := range outerLabels {
+		innerLabel, found := s.findInnerLabelUnsafe(outerLabel)
+		if !found {
+			continue
+		}
+
+		vector, err := s.h.GetDataByLabel(innerLabel)
+		if err != nil {
+			continue
+		}
+		out[outerLabel] = vector
+	}
+
+	return out
+}
+
+// Count returns the number of stored points, deleted ones excluded.
+func (s *Service) Count() int {
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	return len(s.labelInnerMap)
+}
+
+// Range calls fn for every stored ID until fn returns false. It iterates over
+// a copy, so fn may call back into the service.
+func (s *Service) Range(fn func(outerLabel string) bool) {
+	for _, outerLabel := range s.ListIDs() {
+		if !fn(outerLabel) {
+			return
+		}
+	}
+}
+
+// Delete tombstones the vector stored under outerLabel and forgets the label.
+// Putting the same outerLabel again inserts it as a new point.
+func (s *Service) Delete(outerLabel string) error {
+	defer s.lockWrite()()
+
+	labelMtx := s.labelLock(outerLabel)
+	labelMtx.Lock()
+	defer labelMtx.Unlock()
+
+	innerLabel, found := s.findInnerLabel(outerLabel)
+	if !found {
+		return ErrUnknownLabel
+	}
+
+	s.indexMtx.RLock()
+	err := s.h.MarkDelete(innerLabel)
+	s.indexMtx.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	s.rwMtx.Lock()
+	defer s.rwMtx.Unlock()
+
+	s.deleteLabelUnsafe(outerLabel, innerLabel)
+
+	return nil
+}
+
+// SearchOptions tunes a single search. The zero value is a plain k-NN query.
+type SearchOptions struct {
+	// Filter restricts results to the IDs it accepts. It runs under the
+	// service lock and must not call back into the service.
+	Filter func(id string) bool
+	// Contains keeps results whose text contains every entry. Backends that
+	// store no text return ErrUnsupportedOption.
+	Contains [][]byte
+	// Query keeps results matching a boolean query over their text and
+	// metadata; see package query. Backends that store no text return
+	// ErrUnsupportedOption.
+	Query query.Node
+	// Where restricts results to points whose metadata matches. It combines
+	// with Filter like an AND.
+	Where metadata.Expr
+	// EF overrides the ef set with SetEF for this search only; larger values
+	// trade latency for recall. Zero keeps the service ef. Backends without a
+	// graph ignore it.
+	EF int
+}
+
+// Search returns up to resultsNum nearest neighbours of vectors, closest
+// first. See Result for the meaning of distances and scores.
+func (s *Service) Search(vectors []float32, resultsNum int) ([]Result, error) {
+	return s.SearchWithOptions(vectors, resultsNum, SearchOptions{})
+}
+
+func (s *Service) SearchWithOptions(vectors []float32, resultsNum int, opts SearchOptions) ([]Result, error) {
 	if len(vectors) != s.dim {
-		log.Println("search: vector length is not equal to dim")
-		return nil
+		return nil, ErrDimensionMismatch
+	}
+	if len(opts.Contains) > 0 || opts.Query != nil {
+		return nil, ErrUnsupportedOption
 	}
 
+	var search func() ([]uint32, []float32, error)
+	switch {
+	case opts.Filter != nil || opts.Where != nil:
+		s.rwMtx.RLock()
+		search = s.filteredSearchUnsafe(vectors, resultsNum, opts.EF, s.matcherUnsafe(opts))
+		s.rwMtx.RUnlock()
+	case opts.EF > 0:
+		search = func() ([]uint32, []float32, error) {
+			return s.h.SearchKNNWithEf(vectors, resultsNum, opts.EF)
+		}
+	default:
+		search = func() ([]uint32, []float32, error) {
+			return s.h.SearchKNN(vectors, resultsNum)
+		}
+	}
+
+	// writes wait on rwMtx, not on the search
+	s.indexMtx.RLock()
+	innerLabels, distances, err := search()
+	s.indexMtx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// the stats are those of the service ef
+	if opts.Filter == nil && opts.Where == nil && opts.EF == 0 {
+		s.sampleRecall(vectors, resultsNum, innerLabels, distances)
+	}
+
+	return s.results(innerLabels, distances), nil
+}
+
+// SearchRadius returns up to limit points within radius of vectors, closest
+// first; a non-positive limit returns all. Like any graph search it may miss
+// points.
+func (s *Service) SearchRadius(vectors []float32, radius float32, limit int) ([]Result, error) {
+	if len(vectors) != s.dim {
+		return nil, ErrDimensionMismatch
+	}
+
+	count := s.Count()
+	if limit <= 0 || limit > count {
+		limit = count
+	}
+
+	k := radiusSearchInitialK
+	for {
+		if k > limit {
+			k = limit
+		}
+
+		s.indexMtx.RLock()
+		ef := s.ef
+		if ef < k {
+			ef = k
+		}
+		innerLabels, distances, err := s.h.SearchKNNWithEf(vectors, k, ef)
+		s.indexMtx.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+
+		n := len(distances)
+		if n < k || k == limit || distances[n-1] > radius {
+			results := s.results(innerLabels, distances)
+			i := sort.Search(len(results), func(i int) bool {
+				return results[i].Distance > radius
+			})
+			return results[:i], nil
+		}
+
+		k *= 2
+	}
+}
+
+// SearchBatch is Search for many queries, run by Threads native threads in a
+// single call into hnswlib. results[i] holds the neighbours of queries[i].
+func (s *Service) SearchBatch(queries [][]float32, resultsNum int) ([][]Result, error) {
+	for _, query := range queries {
+		if len(query) != s.dim {
+			return nil, ErrDimensionMismatch
+		}
+	}
+
+	s.indexMtx.RLock()
+	innerLabels, distances, err := s.h.SearchKNNBatch(queries, resultsNum, s.threads)
+	s.indexMtx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	results := make([][]Result, len(queries))
+	for i := range queries {
+		results[i] = s.resultsUnsafe(innerLabels[i], distances[i])
+	}
+
+	return results, nil
+}
+
+// results maps the labels a search returned to results. Points deleted since
+// are left out.
+func (s *Service) results(innerLabels []uint32, distances []float32) []Result {
 	s.rwMtx.RLock()
 	defer s.rwMtx.RUnlock()
 
-	innerLabels, distances := s.h.SearchKNN(vectors, resultsNum)
+	return s.resultsUnsafe(innerLabels, distances)
+}
 
-	results := make(map[string]float32, len(innerLabels))
+func (s *Service) resultsUnsafe(innerLabels []uint32, distances []float32) []Result {
+	results := make([]Result, 0, len(innerLabels))
 
 	for i, innerLabel := range innerLabels {
 		outerLabel, found := s.findOuterLabelUnsafe(innerLabel)
 		if !found {
-			panic("outerLabel not found")
+			// deleted
+			continue
 		}
 
-		results[outerLabel] = distances[i]
+		results = append(results, Result{
+			ID:       outerLabel,
+			Distance: distances[i],
+			Score:    s.spaceType.Score(distances[i]),
+			Metadata: s.metadata[innerLabel],
+		})
 	}
 
+	SortResults(results)
+
 	return results
 }
+
+// matcherUnsafe combines the Filter and Where options into a predicate on
+// stored points.
+func (s *Service) matcherUnsafe(opts SearchOptions) func(innerLabel uint32, outerLabel string) bool {
+	return func(innerLabel uint32, outerLabel string) bool {
+		if opts.Filter != nil && !opts.Filter(outerLabel) {
+			return false
+		}
+		return opts.Where == nil || opts.Where.Match(s.metadata[innerLabel])
+	}
+}
+
+// filteredSearchUnsafe turns filter into an allow list checked during graph
+// traversal, returning the search to run under indexMtx. When the filter is
+// very selective, walking the graph would visit most of it anyway, so the
+// allowed points are compared directly.
+func (s *Service) filteredSearchUnsafe(vectors []float32, resultsNum int, ef int, filter func(innerLabel uint32, outerLabel string) bool) func() ([]uint32, []float32, error) {
+	bruteForceLimit := int(s.filterBruteForceRatio * float64(len(s.labelOuterMap)))
+	if bruteForceLimit < 0 {
+		bruteForceLimit = -1
+	}
+
+	allow := hnswgo.NewBitset(s.nextIndex)
+	allowed := make([]uint32, 0, bruteForceLimit+1)
+	count := 0
+	for innerLabel, outerLabel := range s.labelOuterMap {
+		if !filter(innerLabel, outerLabel) {
+			continue
+		}
+		allow.Set(innerLabel)
+		if count <= bruteForceLimit {
+			allowed = append(allowed, innerLabel)
+		}
+		count++
+	}
+
+	return func() ([]uint32, []float32, error) {
+		if count == 0 {
+			return nil, nil, nil
+		}
+		if count <= bruteForceLimit {
+			return s.h.SearchKNNAmong(vectors, resultsNum, allowed)
+		}
+		return s.h.SearchKNNFiltered(vectors, resultsNum, ef, allow)
+	}
+}
+
+// SearchByID returns the resultsNum nearest neighbours of the vector stored
+// under outerLabel, leaving out outerLabel itself. It returns ErrUnknownLabel
+// when outerLabel is not stored.
+func (s *Service) SearchByID(outerLabel string, resultsNum int, opts SearchOptions) ([]Result, error) {
+	vector, found := s.Get(outerLabel)
+	if !found {
+		return nil, ErrUnknownLabel
+	}
+
+	results, err := s.SearchWithOptions(vector, resultsNum+1, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return ExcludeID(results, outerLabel, resultsNum), nil
+}
+
+// SearchMap is Search returning id -> distance.
+func (s *Service) SearchMap(vectors []float32, resultsNum int) (map[string]float32, error) {
+	results, err := s.Search(vectors, resultsNum)
+	if err != nil {
+		return nil, err
+	}
+	return ResultsToMap(results), nil
+}
@@ -0,0 +1,812 @@
+package graph
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hnswgo "github.com/abilitylab/graph/pkg/hnsw"
+	"github.com/abilitylab/graph/pkg/metadata"
+	"github.com/stretchr/testify/require"
+)
+
+const testDim = 16
+
+func randomVector(r *rand.Rand) []float32 {
+	v := make([]float32, testDim)
+	for i := range v {
+		v[i] = r.Float32()*2 - 1
+	}
+	return v
+}
+
+func resultIDs(results []Result) []string {
+	ids := make([]string, len(results))
+	for i, r := range results {
+		ids[i] = r.ID
+	}
+	return ids
+}
+
+func newTestService(t *testing.T, maxElements uint32) *Service {
+	s, err := New(&Configuration{
+		Dim:            testDim,
+		M:              16,
+		EFConstruction: 100,
+		EF:             100,
+		MaxElements:    maxElements,
+		SpaceType:      SpaceTypeCosine,
+	})
+	require.NoError(t, err)
+	return s
+}
+
+func TestDelete(t *testing.T) {
+	s := newTestService(t, 100)
+	r := rand.New(rand.NewSource(1))
+
+	vectors := make(map[string][]float32)
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("id-%d", i)
+		vectors[id] = randomVector(r)
+		require.NoError(t, s.Put(id, append([]float32(nil), vectors[id]...)))
+	}
+
+	require.NoError(t, s.Delete("id-7"))
+	require.ErrorIs(t, s.Delete("id-7"), ErrUnknownLabel)
+	require.ErrorIs(t, s.Delete("missing"), ErrUnknownLabel)
+
+	results, err := s.Search(append([]float32(nil), vectors["id-7"]...), 50)
+	require.NoError(t, err)
+	require.NotContains(t, resultIDs(results), "id-7")
+	require.Len(t, results, 49)
+	require.NotContains(t, s.ListIDs(), "id-7")
+
+	require.NoError(t, s.Put("id-7", append([]float32(nil), vectors["id-7"]...)))
+	results, err = s.Search(append([]float32(nil), vectors["id-7"]...), 1)
+	require.NoError(t, err)
+	require.Equal(t, "id-7", results[0].ID)
+}
+
+func TestPutGrowsIndex(t *testing.T) {
+	var resizes [][2]uint32
+	s, err := New(&Configuration{
+		Dim:            testDim,
+		M:              16,
+		EFConstruction: 100,
+		MaxElements:    10,
+		GrowthFactor:   2,
+		SpaceType:      SpaceTypeL2,
+		OnResize: func(oldMaxElements, newMaxElements uint32) {
+			resizes = append(resizes, [2]uint32{oldMaxElements, newMaxElements})
+		},
+	})
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 35; i++ {
+		require.NoError(t, s.Put(fmt.Sprintf("id-%d", i), randomVector(r)))
+	}
+
+	require.Equal(t, [][2]uint32{{10, 20}, {20, 40}}, resizes)
+	results, err := s.Search(randomVector(r), 35)
+	require.NoError(t, err)
+	require.Len(t, results, 35)
+}
+
+func TestErrors(t *testing.T) {
+	s := newTestService(t, 10)
+
+	require.ErrorIs(t, s.Put("short", make([]float32, testDim-1)), ErrDimensionMismatch)
+	_, err := s.Search(make([]float32, testDim+1), 10)
+	require.ErrorIs(t, err, ErrDimensionMismatch)
+
+	_, err = hnswgo.Load(filepath.Join(t.TempDir(), "missing.bin"), testDim, string(SpaceTypeCosine))
+	require.ErrorIs(t, err, ErrIO)
+	require.ErrorIs(t, s.h.Save(filepath.Join(t.TempDir(), "missing", "index.bin")), ErrIO)
+
+	h, err := hnswgo.New(testDim, 16, 100, 100, 1, string(SpaceTypeL2))
+	require.NoError(t, err)
+	defer h.Free()
+	require.NoError(t, h.AddPoint(make([]float32, testDim), 0))
+	require.ErrorIs(t, h.AddPoint(make([]float32, testDim), 1), ErrCapacityExceeded)
+	require.ErrorIs(t, h.MarkDelete(5), ErrUnknownLabel)
+}
+
+func TestSaveLoad(t *testing.T) {
+	s := newTestService(t, 100)
+	r := rand.New(rand.NewSource(1))
+
+	vectors := make(map[string][]float32)
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("id-%d", i)
+		vectors[id] = randomVector(r)
+		require.NoError(t, s.Put(id, append([]float32(nil), vectors[id]...)))
+	}
+	require.NoError(t, s.Delete("id-3"))
+
+	dir := t.TempDir()
+	require.NoError(t, s.Save(dir))
+
+	cfg := &Configuration{Dim: testDim, M: 16, SpaceType: SpaceTypeCosine}
+	loaded, err := Load(dir, cfg)
+	require.NoError(t, err)
+	require.ElementsMatch(t, s.ListIDs(), loaded.ListIDs())
+	require.Equal(t, 100, loaded.ef)
+
+	for _, id := range []string{"id-0", "id-3", "id-42"} {
+		want, err := s.Search(append([]float32(nil), vectors[id]...), 5)
+		require.NoError(t, err)
+		got, err := loaded.Search(append([]float32(nil), vectors[id]...), 5)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	require.NoError(t, loaded.Put("id-50", randomVector(r)))
+	require.Contains(t, loaded.ListIDs(), "id-50")
+
+	_, err = Load(dir, &Configuration{Dim: testDim, M: 16, SpaceType: SpaceTypeL2})
+	require.ErrorIs(t, err, ErrSnapshotMismatch)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, labelsFile), []byte("garbage"), 0o644))
+	_, err = Load(dir, cfg)
+	require.ErrorIs(t, err, ErrSnapshotChecksum)
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	s := newTestService(t, 100)
+	r := rand.New(rand.NewSource(1))
+
+	vectors := make(map[string][]float32)
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("id-%d", i)
+		vectors[id] = randomVector(r)
+		md := &metadata.Metadata{Numbers: map[string]float64{"n": float64(i)}}
+		require.NoError(t, s.Put(id, append([]float32(nil), vectors[id]...), WithMetadata(md)))
+	}
+	require.NoError(t, s.Delete("id-3"))
+
+	cfg := &Configuration{Dim: testDim, M: 16, SpaceType: SpaceTypeCosine}
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		var buf bytes.Buffer
+		var written int64
+		n, err := s.WriteToWithOptions(&buf, StreamOptions{
+			Compression: compression,
+			Progress:    func(n int64) { written = n },
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(buf.Len()), n)
+		stream := buf.Bytes()
+
+		var read int64
+		loaded, err := ReadFromWithOptions(bytes.NewReader(stream), cfg, StreamOptions{
+			Progress: func(n int64) { read = n },
+		})
+		require.NoError(t, err, compression)
+		require.Positive(t, written)
+		require.Equal(t, written, read)
+		require.ElementsMatch(t, s.ListIDs(), loaded.ListIDs())
+		md, found := loaded.Metadata("id-42")
+		require.True(t, found)
+		require.Equal(t, 42.0, md.Numbers["n"])
+
+		for _, id := range []string{"id-0", "id-3", "id-42"} {
+			want, err := s.Search(append([]float32(nil), vectors[id]...), 5)
+			require.NoError(t, err)
+			got, err := loaded.Search(append([]float32(nil), vectors[id]...), 5)
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+		}
+		require.NoError(t, loaded.Put("id-50", randomVector(r)))
+
+		_, err = ReadFrom(bytes.NewReader(stream), &Configuration{Dim: testDim, M: 16, SpaceType: SpaceTypeL2})
+		require.ErrorIs(t, err, ErrSnapshotMismatch)
+		_, err = ReadFrom(bytes.NewReader(stream[:len(stream)-10]), cfg)
+		require.ErrorIs(t, err, ErrIO)
+	}
+
+	var buf bytes.Buffer
+	_, err := s.WriteTo(&buf)
+	require.NoError(t, err)
+	stream := buf.Bytes()
+	i := bytes.Index(stream, []byte(`"n":42`))
+	require.Positive(t, i)
+	stream[i+4] = '5'
+	_, err = ReadFrom(bytes.NewReader(stream), cfg)
+	require.ErrorIs(t, err, ErrSnapshotChecksum)
+}
+
+func TestDeterministic(t *testing.T) {
+	build := func(seed int, exact bool) string {
+		s, err := New(&Configuration{
+			Dim:            testDim,
+			M:              8,
+			EFConstruction: 50,
+			MaxElements:    16,
+			SpaceType:      SpaceTypeCosine,
+			Seed:           seed,
+			Threads:        4,
+			Exact:          exact,
+			Deterministic:  true,
+		})
+		require.NoError(t, err)
+		r := rand.New(rand.NewSource(1))
+
+		for i := 0; i < 200; i++ {
+			md := &metadata.Metadata{Numbers: map[string]float64{"n": float64(i)}}
+			require.NoError(t, s.Put(fmt.Sprintf("id-%d", i), randomVector(r), WithMetadata(md)))
+		}
+		ids := make([]string, 300)
+		vectors := make([][]float32, len(ids))
+		for i := range ids {
+			ids[i] = fmt.Sprintf("id-%d", 100+i)
+			vectors[i] = randomVector(r)
+		}
+		require.NoError(t, s.PutBatch(ids, vectors))
+		require.NoError(t, s.Delete("id-7"))
+
+		dir := t.TempDir()
+		require.NoError(t, s.Save(dir))
+		return dir
+	}
+
+	same := func(t *testing.T, first, second string) {
+		for _, name := range []string{manifestFile, indexFile, labelsFile, metadataFile} {
+			want, err := os.ReadFile(filepath.Join(first, name))
+			require.NoError(t, err)
+			got, err := os.ReadFile(filepath.Join(second, name))
+			require.NoError(t, err)
+			require.Equal(t, want, got, name)
+		}
+	}
+
+	t.Run("hnsw", func(t *testing.T) {
+		first := build(7, false)
+		same(t, first, build(7, false))
+
+		want, err := os.ReadFile(filepath.Join(first, indexFile))
+		require.NoError(t, err)
+		got, err := os.ReadFile(filepath.Join(build(8, false), indexFile))
+		require.NoError(t, err)
+		require.NotEqual(t, want, got)
+	})
+
+	t.Run("exact", func(t *testing.T) {
+		same(t, build(7, true), build(7, true))
+	})
+}
+
+func TestSearchResultsRanked(t *testing.T) {
+	s, err := New(&Configuration{
+		Dim:            2,
+		M:              16,
+		EFConstruction: 100,
+		SpaceType:      SpaceTypeL2,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Put("far", []float32{3, 0}))
+	require.NoError(t, s.Put("b", []float32{0, 1}))
+	require.NoError(t, s.Put("a", []float32{1, 0}))
+	require.NoError(t, s.Put("near", []float32{0, 0.5}))
+
+	results, err := s.Search([]float32{0, 0}, 4)
+	require.NoError(t, err)
+	require.Equal(t, []Result{
+		{ID: "near", Distance: 0.25, Score: 0.8},
+		{ID: "a", Distance: 1, Score: 0.5},
+		{ID: "b", Distance: 1, Score: 0.5},
+		{ID: "far", Distance: 9, Score: 0.1},
+	}, results)
+
+	m, err := s.SearchMap([]float32{0, 0}, 4)
+	require.NoError(t, err)
+	require.Equal(t, map[string]float32{"near": 0.25, "a": 1, "b": 1, "far": 9}, m)
+}
+
+func TestSearchFiltered(t *testing.T) {
+	for name, ratio := range map[string]float64{"graph": -1, "bruteforce": 0.5} {
+		t.Run(name, func(t *testing.T) {
+			s, err := New(&Configuration{
+				Dim:                   testDim,
+				M:                     8,
+				EFConstruction:        50,
+				MaxElements:           2000,
+				SpaceType:             SpaceTypeL2,
+				FilterBruteForceRatio: ratio,
+			})
+			require.NoError(t, err)
+			r := rand.New(rand.NewSource(1))
+
+			for i := 0; i < 2000; i++ {
+				require.NoError(t, s.Put(fmt.Sprintf("id-%d", i), randomVector(r)))
+			}
+			require.NoError(t, s.Delete("id-10"))
+
+			// one point in a hundred
+			filter := func(id string) bool {
+				var n int
+				fmt.Sscanf(id, "id-%d", &n)
+				return n%100 == 10
+			}
+
+			results, err := s.SearchWithOptions(randomVector(r), 15, SearchOptions{Filter: filter})
+			require.NoError(t, err)
+			require.Len(t, results, 15)
+			for _, result := range results {
+				require.True(t, filter(result.ID), result.ID)
+				require.NotEqual(t, "id-10", result.ID)
+			}
+
+			results, err = s.SearchWithOptions(randomVector(r), 50, SearchOptions{Filter: filter})
+			require.NoError(t, err)
+			require.Len(t, results, 19)
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	s := newTestService(t, 100)
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 50; i++ {
+		category := "even"
+		if i%2 == 1 {
+			category = "odd"
+		}
+		md := &metadata.Metadata{
+			Tags:    map[string][]string{"category": {category}},
+			Numbers: map[string]float64{"n": float64(i)},
+		}
+		require.NoError(t, s.Put(fmt.Sprintf("id-%d", i), randomVector(r), WithMetadata(md)))
+	}
+
+	// a Put without metadata keeps the stored payload
+	require.NoError(t, s.Put("id-1", randomVector(r)))
+	md, found := s.Metadata("id-1")
+	require.True(t, found)
+	require.Equal(t, []string{"odd"}, md.Tags["category"])
+
+	where, err := metadata.Parse(`category = "odd" AND n < 20`)
+	require.NoError(t, err)
+
+	results, err := s.SearchWithOptions(randomVector(r), 50, SearchOptions{Where: where})
+	require.NoError(t, err)
+	require.Len(t, results, 10)
+	for _, result := range results {
+		require.True(t, where.Match(result.Metadata), result.ID)
+	}
+
+	require.NoError(t, s.Delete("id-1"))
+	require.NoError(t, s.Put("id-1", randomVector(r)))
+	md, found = s.Metadata("id-1")
+	require.True(t, found)
+	require.Nil(t, md)
+
+	dir := t.TempDir()
+	require.NoError(t, s.Save(dir))
+	loaded, err := Load(dir, &Configuration{Dim: testDim, M: 16, SpaceType: SpaceTypeCosine})
+	require.NoError(t, err)
+
+	results, err = loaded.SearchWithOptions(randomVector(r), 50, SearchOptions{Where: where})
+	require.NoError(t, err)
+	require.Len(t, results, 9)
+	md, _ = loaded.Metadata("id-3")
+	require.Equal(t, float64(3), md.Numbers["n"])
+}
+
+func TestGet(t *testing.T) {
+	s := newTestService(t, 10)
+
+	require.NoError(t, s.Put("a", []float32{3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}))
+	vector, ok := s.Get("a")
+	require.True(t, ok)
+	// cosine indexes store normalized vectors
+	require.InDeltaSlice(t, []float32{0.6, 0.8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, vector, 1e-6)
+
+	_, ok = s.Get("b")
+	require.False(t, ok)
+
+	vectors := s.GetMany([]string{"a", "b"})
+	require.Len(t, vectors, 1)
+	require.Equal(t, vector, vectors["a"])
+}
+
+func TestConcurrentPut(t *testing.T) {
+	s := newTestService(t, 10)
+
+	const workers, perWorker = 8, 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < perWorker; i++ {
+				id := fmt.Sprintf("id-%d", i%(perWorker/2))
+				if w%2 == 1 {
+					id = fmt.Sprintf("id-%d-%d", w, i)
+				}
+				require.NoError(t, s.Put(id, randomVector(r)))
+				_, err := s.Search(randomVector(r), 5)
+				require.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	require.Equal(t, perWorker/2+workers/2*perWorker, s.Count())
+	s.Range(func(id string) bool {
+		_, ok := s.Get(id)
+		require.True(t, ok, id)
+		return true
+	})
+}
+
+func benchmarkPut(b *testing.B, put func(s *Service, id string, vector []float32) error) {
+	s, err := New(&Configuration{
+		Dim:            testDim,
+		M:              16,
+		EFConstruction: 100,
+		MaxElements:    1024,
+		SpaceType:      SpaceTypeCosine,
+		OnResize:       func(uint32, uint32) {},
+	})
+	require.NoError(b, err)
+	var n atomic.Int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(n.Add(1)))
+		for pb.Next() {
+			id := fmt.Sprintf("id-%d", n.Add(1))
+			if err := put(s, id, randomVector(r)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPut(b *testing.B) {
+	benchmarkPut(b, func(s *Service, id string, vector []float32) error {
+		return s.Put(id, vector)
+	})
+}
+
+// BenchmarkPutSerialized holds a lock around every Put, the way Put used to
+// lock the whole service, for comparison with BenchmarkPut.
+func BenchmarkPutSerialized(b *testing.B) {
+	var mtx sync.Mutex
+	benchmarkPut(b, func(s *Service, id string, vector []float32) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return s.Put(id, vector)
+	})
+}
+
+func TestBatch(t *testing.T) {
+	s, err := New(&Configuration{
+		Dim:            testDim,
+		M:              16,
+		EFConstruction: 100,
+		EF:             100,
+		MaxElements:    10,
+		SpaceType:      SpaceTypeL2,
+		Threads:        4,
+	})
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+
+	ids := make([]string, 500)
+	vectors := make([][]float32, 500)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("id-%d", i)
+		vectors[i] = randomVector(r)
+	}
+	// the last vector for a repeated ID wins
+	ids[499] = "id-0"
+	require.NoError(t, s.PutBatch(ids, vectors))
+	require.Equal(t, 499, s.Count())
+
+	vector, ok := s.Get("id-0")
+	require.True(t, ok)
+	require.Equal(t, vectors[499], vector)
+
+	queries := [][]float32{randomVector(r), vectors[10], randomVector(r)}
+	batch, err := s.SearchBatch(queries, 5)
+	require.NoError(t, err)
+	require.Len(t, batch, len(queries))
+	for i, query := range queries {
+		results, err := s.Search(query, 5)
+		require.NoError(t, err)
+		require.Equal(t, results, batch[i])
+	}
+	require.Equal(t, "id-10", batch[1][0].ID)
+
+	require.ErrorIs(t, s.PutBatch([]string{"a"}, nil), ErrBatchLength)
+	require.ErrorIs(t, s.PutBatch([]string{"a"}, [][]float32{{1}}), ErrDimensionMismatch)
+	_, err = s.SearchBatch([][]float32{{1}}, 5)
+	require.ErrorIs(t, err, ErrDimensionMismatch)
+}
+
+func TestSearchEF(t *testing.T) {
+	s, err := New(&Configuration{
+		Dim:            testDim,
+		M:              4,
+		EFConstruction: 20,
+		EF:             1,
+		SpaceType:      SpaceTypeL2,
+	})
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+
+	vectors := make([][]float32, 2000)
+	for i := range vectors {
+		vectors[i] = randomVector(r)
+		require.NoError(t, s.Put(fmt.Sprintf("id-%d", i), vectors[i]))
+	}
+
+	recall := func(ef int) int {
+		hits := 0
+		for q := 0; q < 20; q++ {
+			query := randomVector(r)
+			results, err := s.SearchWithOptions(query, 10, SearchOptions{EF: ef})
+			require.NoError(t, err)
+			hits += len(intersect(resultIDs(results), exactKNN(vectors, query, 10)))
+		}
+		return hits
+	}
+
+	low, high := recall(10), recall(400)
+	require.Greater(t, high, low)
+	require.GreaterOrEqual(t, high, 195)
+	// per-query ef leaves the service ef alone
+	require.Equal(t, 1, s.ef)
+}
+
+// exactKNN returns the IDs of the k vectors closest to query by L2 distance.
+func exactKNN(vectors [][]float32, query []float32, k int) []string {
+	results := make([]Result, len(vectors))
+	for i, v := range vectors {
+		var d float32
+		for j := range v {
+			d += (v[j] - query[j]) * (v[j] - query[j])
+		}
+		results[i] = Result{ID: fmt.Sprintf("id-%d", i), Distance: d}
+	}
+	SortResults(results)
+	return resultIDs(results[:k])
+}
+
+func intersect(a, b []string) []string {
+	var out []string
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				out = append(out, x)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func TestSearchRadius(t *testing.T) {
+	s, err := New(&Configuration{
+		Dim:            testDim,
+		M:              16,
+		EFConstruction: 100,
+		SpaceType:      SpaceTypeL2,
+		OnResize:       func(uint32, uint32) {},
+	})
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+
+	vectors := make([][]float32, 2000)
+	for i := range vectors {
+		vectors[i] = randomVector(r)
+		require.NoError(t, s.Put(fmt.Sprintf("id-%d", i), vectors[i]))
+	}
+
+	query := vectors[0]
+	exact := make([]Result, len(vectors))
+	for i, v := range vectors {
+		var d float32
+		for j := range v {
+			d += (v[j] - query[j]) * (v[j] - query[j])
+		}
+		exact[i] = Result{ID: fmt.Sprintf("id-%d", i), Distance: d}
+	}
+	SortResults(exact)
+	radius := exact[100].Distance
+	within := resultIDs(exact[:101])
+
+	// more than the first round of the search asks for
+	require.Greater(t, len(within), radiusSearchInitialK*2)
+
+	results, err := s.SearchRadius(query, radius, 0)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(intersect(resultIDs(results), within)), len(within)*95/100)
+	for _, result := range results {
+		require.LessOrEqual(t, result.Distance, radius)
+	}
+
+	results, err = s.SearchRadius(query, radius, 10)
+	require.NoError(t, err)
+	require.Equal(t, within[:10], resultIDs(results))
+
+	results, err = s.SearchRadius(query, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"id-0"}, resultIDs(results))
+}
+
+func TestExact(t *testing.T) {
+	cfg := &Configuration{Dim: testDim, MaxElements: 16, SpaceType: SpaceTypeL2, Exact: true}
+	s, err := New(cfg)
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+
+	vectors := make([][]float32, 300)
+	for i := range vectors {
+		vectors[i] = randomVector(r)
+		require.NoError(t, s.Put(fmt.Sprintf("id-%d", i), vectors[i]))
+	}
+
+	query := randomVector(r)
+	results, err := s.Search(query, 10)
+	require.NoError(t, err)
+	require.Equal(t, exactKNN(vectors, query, 10), resultIDs(results))
+
+	results, err = s.SearchWithOptions(query, 10, SearchOptions{
+		Filter: func(id string) bool { return id == "id-7" || id == "id-8" },
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"id-7", "id-8"}, resultIDs(results))
+
+	batch, err := s.SearchBatch([][]float32{query, vectors[5]}, 10)
+	require.NoError(t, err)
+	require.Equal(t, exactKNN(vectors, query, 10), resultIDs(batch[0]))
+	require.Equal(t, "id-5", batch[1][0].ID)
+
+	require.NoError(t, s.Delete("id-5"))
+	results, err = s.Search(vectors[5], 1)
+	require.NoError(t, err)
+	require.NotEqual(t, "id-5", results[0].ID)
+	require.NoError(t, s.Put("id-5", vectors[5]))
+
+	dir := t.TempDir()
+	require.NoError(t, s.Save(dir))
+
+	loaded, err := Load(dir, cfg)
+	require.NoError(t, err)
+	require.Equal(t, 300, loaded.Count())
+	got, err := loaded.Search(query, 10)
+	require.NoError(t, err)
+	require.Equal(t, exactKNN(vectors, query, 10), resultIDs(got))
+
+	_, err = Load(dir, &Configuration{Dim: testDim, SpaceType: SpaceTypeL2})
+	require.ErrorIs(t, err, ErrSnapshotMismatch)
+
+	// deleted points free their slot, so churn does not grow the index
+	s, err = New(&Configuration{Dim: testDim, MaxElements: 10, SpaceType: SpaceTypeL2, Exact: true})
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, s.Put("churn", vectors[i%len(vectors)]))
+		require.NoError(t, s.Delete("churn"))
+	}
+	require.NoError(t, s.PutBatch([]string{"a", "b"}, vectors[:2]))
+	require.Equal(t, 2, s.Count())
+	require.Equal(t, uint32(10), s.h.MaxElements())
+}
+
+func TestRecall(t *testing.T) {
+	s, err := New(&Configuration{
+		Dim:              testDim,
+		M:                4,
+		EFConstruction:   20,
+		EF:               1,
+		SpaceType:        SpaceTypeL2,
+		RecallSampleRate: 1,
+	})
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, s.Put(fmt.Sprintf("id-%d", i), randomVector(r)))
+	}
+
+	queries := make([][]float32, 20)
+	for i := range queries {
+		queries[i] = randomVector(r)
+	}
+
+	low, err := s.EvaluateRecall(queries, 10)
+	require.NoError(t, err)
+	require.Equal(t, 20, low.Queries)
+	require.Greater(t, low.MeanDistanceError, 0.0)
+
+	s.SetEF(400)
+	high, err := s.EvaluateRecall(queries, 10)
+	require.NoError(t, err)
+	require.Greater(t, high.Recall, low.Recall)
+	require.GreaterOrEqual(t, high.Recall, 0.95)
+	require.GreaterOrEqual(t, high.MaxDistanceError, 0.0)
+	require.Less(t, high.MeanDistanceError, low.MeanDistanceError)
+
+	// live searches are sampled in the background
+	require.Zero(t, s.RecallStats().Queries)
+	require.Eventually(t, func() bool {
+		_, err := s.Search(queries[0], 10)
+		require.NoError(t, err)
+		return s.RecallStats().Queries > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Greater(t, s.RecallStats().Recall, 0.0)
+
+	// wait out a sample still in flight
+	s.recall.busy <- struct{}{}
+	s.ResetRecallStats()
+	require.Zero(t, s.RecallStats().Queries)
+}
+
+func TestTuneEF(t *testing.T) {
+	tuned := make(chan TuneResult, 1)
+	s, err := New(&Configuration{
+		Dim:            testDim,
+		M:              4,
+		EFConstruction: 20,
+		EF:             1,
+		SpaceType:      SpaceTypeL2,
+		Tune:           &TuneTarget{Recall: 0.9},
+		OnTune:         func(r TuneResult) { tuned <- r },
+	})
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+
+	_, ok := s.TunedEF()
+	require.False(t, ok)
+
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, s.Put(fmt.Sprintf("id-%d", i), randomVector(r)))
+	}
+
+	// the first automatic tuning starts at 1000 points
+	select {
+	case result := <-tuned:
+		require.True(t, result.Met, "%+v", result)
+		require.GreaterOrEqual(t, result.Count, 1000)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no automatic tuning")
+	}
+	// wait out a retuning still in flight
+	s.tune.busy <- struct{}{}
+
+	result, err := s.TuneEF(TuneTarget{Recall: 0.95, SampleSize: 50})
+	require.NoError(t, err)
+	require.True(t, result.Met)
+	require.GreaterOrEqual(t, result.Recall, 0.95)
+	require.Equal(t, 2000, result.Count)
+	require.Equal(t, result.EF, s.ef)
+	last, ok := s.TunedEF()
+	require.True(t, ok)
+	require.Equal(t, result, last)
+
+	result, err = s.TuneEF(TuneTarget{P99: time.Hour, SampleSize: 10, MaxEF: 100})
+	require.NoError(t, err)
+	require.True(t, result.Met)
+	require.Equal(t, 100, result.EF)
+
+	result, err = s.TuneEF(TuneTarget{Recall: 1, P99: time.Nanosecond, SampleSize: 10})
+	require.NoError(t, err)
+	require.False(t, result.Met)
+	require.Equal(t, 10, result.EF)
+
+	_, err = s.TuneEF(TuneTarget{})
+	require.ErrorIs(t, err, ErrTuneTarget)
+}
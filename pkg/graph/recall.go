@@ -0,0 +1,156 @@
+package graph
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+)
+
+// RecallStats compares graph searches with an exact scan over the same
+// stored vectors.
+type RecallStats struct {
+	// Queries is the number of searches compared.
+	Queries int `json:"queries"`
+	// Recall is recall@k averaged over queries: the share of the exact k
+	// nearest neighbours the search returned.
+	Recall float64 `json:"recall"`
+	// MeanDistanceError is the mean gap between the distance of the i-th
+	// result and that of the true i-th nearest neighbour.
+	MeanDistanceError float64 `json:"mean_distance_error"`
+	// MaxDistanceError is the largest such gap.
+	MaxDistanceError float64 `json:"max_distance_error"`
+}
+
+type recallAccumulator struct {
+	queries          int
+	recall           float64
+	distances        int
+	distanceError    float64
+	maxDistanceError float64
+}
+
+func (a *recallAccumulator) add(innerLabels []uint32, distances []float32, exactLabels []uint32, exactDistances []float32) {
+	if len(exactLabels) == 0 {
+		return
+	}
+
+	a.queries++
+	a.recall += float64(len(intersectLabels(innerLabels, exactLabels))) / float64(len(exactLabels))
+
+	for i := 0; i < len(distances) && i < len(exactDistances); i++ {
+		gap := float64(distances[i] - exactDistances[i])
+		a.distances++
+		a.distanceError += gap
+		if gap > a.maxDistanceError {
+			a.maxDistanceError = gap
+		}
+	}
+}
+
+func (a *recallAccumulator) stats() RecallStats {
+	stats := RecallStats{Queries: a.queries, MaxDistanceError: a.maxDistanceError}
+	if a.queries > 0 {
+		stats.Recall = a.recall / float64(a.queries)
+	}
+	if a.distances > 0 {
+		stats.MeanDistanceError = a.distanceError / float64(a.distances)
+	}
+	return stats
+}
+
+// recallMonitor accumulates the recall of sampled live searches. busy holds
+// a token while a sample is evaluated; samples arriving meanwhile are dropped
+// rather than queued, so the monitor never costs more than one core.
+type recallMonitor struct {
+	rate float64
+	busy chan struct{}
+
+	mtx sync.Mutex
+	acc recallAccumulator
+}
+
+// RecallStats returns the recall measured on live searches sampled at
+// Configuration.RecallSampleRate since the service started or
+// ResetRecallStats was called. Only unfiltered searches without an EF of
+// their own are sampled; reset the stats after SetEF.
+func (s *Service) RecallStats() RecallStats {
+	s.recall.mtx.Lock()
+	defer s.recall.mtx.Unlock()
+
+	return s.recall.acc.stats()
+}
+
+func (s *Service) ResetRecallStats() {
+	s.recall.mtx.Lock()
+	defer s.recall.mtx.Unlock()
+
+	s.recall.acc = recallAccumulator{}
+}
+
+// sampleRecall reruns a search exactly in the background, for a
+// RecallSampleRate share of the calls. Points written in the meantime count
+// against the search, so recall under heavy writes reads slightly low.
+func (s *Service) sampleRecall(vectors []float32, resultsNum int, innerLabels []uint32, distances []float32) {
+	if s.exact || s.recall.rate <= 0 || rand.Float64() >= s.recall.rate {
+		return
+	}
+
+	select {
+	case s.recall.busy <- struct{}{}:
+	default:
+		return
+	}
+
+	vectors = append([]float32(nil), vectors...)
+	go func() {
+		defer func() { <-s.recall.busy }()
+
+		exactLabels, exactDistances, err := s.searchExact(vectors, resultsNum)
+		if err != nil {
+			log.Printf("graph: recall sample: %v", err)
+			return
+		}
+
+		s.recall.mtx.Lock()
+		defer s.recall.mtx.Unlock()
+
+		s.recall.acc.add(innerLabels, distances, exactLabels, exactDistances)
+	}()
+}
+
+// EvaluateRecall searches each query with the current ef and compares the
+// resultsNum results against an exact scan. It does not touch the live
+// statistics.
+func (s *Service) EvaluateRecall(queries [][]float32, resultsNum int) (RecallStats, error) {
+	var acc recallAccumulator
+
+	for _, query := range queries {
+		if len(query) != s.dim {
+			return RecallStats{}, ErrDimensionMismatch
+		}
+
+		s.indexMtx.RLock()
+		innerLabels, distances, err := s.h.SearchKNN(query, resultsNum)
+		s.indexMtx.RUnlock()
+		if err != nil {
+			return RecallStats{}, err
+		}
+
+		exactLabels, exactDistances, err := s.searchExact(query, resultsNum)
+		if err != nil {
+			return RecallStats{}, err
+		}
+
+		acc.add(innerLabels, distances, exactLabels, exactDistances)
+	}
+
+	return acc.stats(), nil
+}
+
+// searchExact compares vectors with every stored point.
+func (s *Service) searchExact(vectors []float32, resultsNum int) ([]uint32, []float32, error) {
+	s.indexMtx.RLock()
+	defer s.indexMtx.RUnlock()
+
+	return s.h.SearchKNNExact(vectors, resultsNum)
+}
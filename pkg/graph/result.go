@@ -0,0 +1,71 @@
+package graph
+
+import (
+	"sort"
+
+	"github.com/abilitylab/graph/pkg/metadata"
+)
+
+// Result is a single search hit. Search results come closest first; hits at
+// the same distance are ordered by ID, so equal inputs give equal output.
+//
+// Distance is what hnswlib computes for the space type, Score turns it into a
+// similarity where higher is better:
+//
+//   - SpaceTypeCosine: Distance is 1 - cosine similarity, Score is the cosine
+//     similarity in [-1, 1].
+//   - SpaceTypeIP: Distance is 1 - inner product, Score is the inner product.
+//   - SpaceTypeL2: Distance is the squared euclidean distance, Score is
+//     1 / (1 + Distance) in (0, 1].
+type Result struct {
+	ID       string  `json:"id"`
+	Distance float32 `json:"distance"`
+	Score    float32 `json:"score"`
+	// Metadata is the payload stored with the point, if any. It is shared
+	// with the service and must not be modified.
+	Metadata *metadata.Metadata `json:"metadata,omitempty"`
+}
+
+// Score converts a distance of this space type into a Result score.
+func (t SpaceType) Score(distance float32) float32 {
+	switch t {
+	case SpaceTypeIP, SpaceTypeCosine:
+		return 1 - distance
+	default:
+		return 1 / (1 + distance)
+	}
+}
+
+// SortResults orders results by distance, then by ID.
+func SortResults(results []Result) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Distance != results[j].Distance {
+			return results[i].Distance < results[j].Distance
+		}
+		return results[i].ID < results[j].ID
+	})
+}
+
+// ResultsToMap returns the id -> distance form used by the map based APIs.
+func ResultsToMap(results []Result) map[string]float32 {
+	out := make(map[string]float32, len(results))
+	for _, r := range results {
+		out[r.ID] = r.Distance
+	}
+	return out
+}
+
+// ExcludeID drops the result for id and truncates results to at most limit
+// entries.
+func ExcludeID(results []Result, id string, limit int) []Result {
+	out := results[:0]
+	for _, r := range results {
+		if r.ID != id {
+			out = append(out, r)
+		}
+	}
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
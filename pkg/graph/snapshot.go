@@ -0,0 +1,359 @@
+package graph
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	hnswgo "github.com/abilitylab/graph/pkg/hnsw"
+	"github.com/abilitylab/graph/pkg/metadata"
+)
+
+// A snapshot is a directory holding the hnswlib index, the label mapping, the
+// metadata payloads and a manifest. The manifest is written last, so a
+// directory without one is an interrupted Save.
+
+// Version 1 snapshots have no metadata file and still load.
+const snapshotVersion = 2
+
+const (
+	manifestFile = "manifest.json"
+	indexFile    = "index.hnsw"
+	labelsFile   = "labels.bin"
+	metadataFile = "metadata.json"
+)
+
+var (
+	ErrSnapshotVersion  = errors.New("graph: unsupported snapshot version")
+	ErrSnapshotMismatch = errors.New("graph: snapshot does not match configuration")
+	ErrSnapshotChecksum = errors.New("graph: snapshot checksum mismatch")
+)
+
+type manifest struct {
+	Version        int               `json:"version"`
+	Dim            int               `json:"dim"`
+	M              int               `json:"m"`
+	EFConstruction int               `json:"ef_construction"`
+	EF             int               `json:"ef"`
+	SpaceType      SpaceType         `json:"space_type"`
+	Exact          bool              `json:"exact,omitempty"`
+	NextIndex      uint32            `json:"next_index"`
+	Checksums      map[string]string `json:"checksums,omitempty"`
+}
+
+// Save writes a snapshot of the service to dir, creating it if needed.
+// Searches keep running while Save is in progress; Put and Delete wait.
+func (s *Service) Save(dir string) error {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	s.indexMtx.RLock()
+	defer s.indexMtx.RUnlock()
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+
+	// an old manifest must not describe the new files
+	if err := os.Remove(filepath.Join(dir, manifestFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+
+	if err := s.h.Save(filepath.Join(dir, indexFile)); err != nil {
+		return err
+	}
+
+	if err := writeFile(filepath.Join(dir, labelsFile), s.writeLabelsUnsafe); err != nil {
+		return err
+	}
+
+	if err := writeFile(filepath.Join(dir, metadataFile), s.writeMetadataUnsafe); err != nil {
+		return err
+	}
+
+	m := s.manifestUnsafe()
+	m.Checksums = make(map[string]string, 3)
+	for _, name := range snapshotFiles(snapshotVersion) {
+		sum, err := fileChecksum(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		m.Checksums[name] = sum
+	}
+
+	return writeFile(filepath.Join(dir, manifestFile), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(&m)
+	})
+}
+
+// Load restores a service saved with Save. Dim, M, SpaceType and Exact of cfg
+// must match the snapshot, as must EFConstruction when set. A zero cfg.EF keeps the
+// ef stored in the snapshot.
+func Load(dir string, cfg *Configuration) (*Service, error) {
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !m.matches(cfg) {
+		return nil, ErrSnapshotMismatch
+	}
+
+	for _, name := range snapshotFiles(m.Version) {
+		sum, err := fileChecksum(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if sum != m.Checksums[name] {
+			return nil, fmt.Errorf("%w: %s", ErrSnapshotChecksum, name)
+		}
+	}
+
+	var h index
+	if m.Exact {
+		h, err = hnswgo.LoadBruteforce(filepath.Join(dir, indexFile), m.Dim, string(m.SpaceType))
+	} else {
+		h, err = hnswgo.Load(filepath.Join(dir, indexFile), m.Dim, string(m.SpaceType))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := m.newService(cfg, h)
+
+	f, err := os.Open(filepath.Join(dir, labelsFile))
+	if err != nil {
+		h.Free()
+		return nil, fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	defer f.Close()
+
+	if err := s.readLabels(bufio.NewReader(f)); err != nil {
+		h.Free()
+		return nil, err
+	}
+
+	if m.Version >= 2 {
+		data, err := os.ReadFile(filepath.Join(dir, metadataFile))
+		if err != nil {
+			h.Free()
+			return nil, fmt.Errorf("%w: %v", ErrIO, err)
+		}
+		if err := s.readMetadata(data); err != nil {
+			h.Free()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// manifestUnsafe describes the service, without checksums.
+func (s *Service) manifestUnsafe() manifest {
+	return manifest{
+		Version:        snapshotVersion,
+		Dim:            s.dim,
+		M:              s.m,
+		EFConstruction: s.efConstruction,
+		EF:             s.ef,
+		SpaceType:      s.spaceType,
+		Exact:          s.exact,
+		NextIndex:      s.nextIndex,
+	}
+}
+
+// matches tells whether a snapshot with manifest m may be loaded with cfg.
+func (m *manifest) matches(cfg *Configuration) bool {
+	return m.Dim == cfg.Dim && m.M == cfg.M && m.SpaceType == cfg.SpaceType && m.Exact == cfg.Exact &&
+		(cfg.EFConstruction == 0 || m.EFConstruction == cfg.EFConstruction)
+}
+
+// newService builds the service of a loaded snapshot around h. A zero cfg.EF
+// keeps the ef stored in the snapshot.
+func (m *manifest) newService(cfg *Configuration, h index) *Service {
+	loadCfg := *cfg
+	loadCfg.EFConstruction = m.EFConstruction
+	if loadCfg.EF == 0 {
+		loadCfg.EF = m.EF
+	}
+
+	s := newService(&loadCfg, h)
+	s.nextIndex = m.NextIndex
+	return s
+}
+
+func snapshotFiles(version int) []string {
+	if version < 2 {
+		return []string{indexFile, labelsFile}
+	}
+	return []string{indexFile, labelsFile, metadataFile}
+}
+
+func readManifest(dir string) (*manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIO, err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: manifest: %v", ErrIO, err)
+	}
+
+	if m.Version < 1 || m.Version > snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSnapshotVersion, m.Version)
+	}
+
+	return &m, nil
+}
+
+// writeLabelsUnsafe writes the label mapping ordered by inner label: a uint32
+// count followed by (inner label, id length, id) records, little endian.
+func (s *Service) writeLabelsUnsafe(w io.Writer) error {
+	innerLabels := make([]uint32, 0, len(s.labelOuterMap))
+	for innerLabel := range s.labelOuterMap {
+		innerLabels = append(innerLabels, innerLabel)
+	}
+	sort.Slice(innerLabels, func(i, j int) bool {
+		return innerLabels[i] < innerLabels[j]
+	})
+
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(innerLabels))); err != nil {
+		return err
+	}
+
+	for _, innerLabel := range innerLabels {
+		outerLabel := s.labelOuterMap[innerLabel]
+		if err := binary.Write(w, binary.LittleEndian, [2]uint32{innerLabel, uint32(len(outerLabel))}); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, outerLabel); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) readLabels(r io.Reader) error {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return fmt.Errorf("%w: labels: %v", ErrIO, err)
+	}
+
+	s.labelInnerMap = make(map[string]uint32, count)
+	s.labelOuterMap = make(map[uint32]string, count)
+
+	for i := uint32(0); i < count; i++ {
+		var header [2]uint32
+		if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+			return fmt.Errorf("%w: labels: %v", ErrIO, err)
+		}
+
+		outerLabel := make([]byte, header[1])
+		if _, err := io.ReadFull(r, outerLabel); err != nil {
+			return fmt.Errorf("%w: labels: %v", ErrIO, err)
+		}
+
+		if header[0] >= s.nextIndex {
+			return fmt.Errorf("%w: labels: inner label %d out of range", ErrIO, header[0])
+		}
+
+		s.labelInnerMap[string(outerLabel)] = header[0]
+		s.labelOuterMap[header[0]] = string(outerLabel)
+	}
+
+	return nil
+}
+
+type metadataRecord struct {
+	Label    uint32             `json:"label"`
+	Metadata *metadata.Metadata `json:"metadata"`
+}
+
+// writeMetadataUnsafe writes the metadata payloads as a JSON array ordered by
+// inner label.
+func (s *Service) writeMetadataUnsafe(w io.Writer) error {
+	records := make([]metadataRecord, 0, len(s.metadata))
+	for innerLabel, md := range s.metadata {
+		records = append(records, metadataRecord{Label: innerLabel, Metadata: md})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Label < records[j].Label
+	})
+
+	return json.NewEncoder(w).Encode(records)
+}
+
+func (s *Service) readMetadata(data []byte) error {
+	var records []metadataRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("%w: metadata: %v", ErrIO, err)
+	}
+
+	s.metadata = make(map[uint32]*metadata.Metadata, len(records))
+	for _, r := range records {
+		if _, found := s.labelOuterMap[r.Label]; !found {
+			return fmt.Errorf("%w: metadata: unknown inner label %d", ErrIO, r.Label)
+		}
+		s.metadata[r.Label] = r.Metadata
+	}
+
+	return nil
+}
+
+// writeFile writes through a temporary file renamed into place on success.
+func writeFile(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+
+	bw := bufio.NewWriter(f)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%w: %v", ErrIO, err)
+	}
+
+	return nil
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrIO, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
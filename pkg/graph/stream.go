@@ -0,0 +1,324 @@
+package graph
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	hnswgo "github.com/abilitylab/graph/pkg/hnsw"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A stream is a snapshot in one piece: magic, manifest, index, labels,
+// metadata and the SHA-256 of all of it, optionally gzip or zstd compressed.
+
+const streamMagic = "GRAPHSNP"
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// progressInterval is the number of bytes between two Progress calls.
+const progressInterval = 1 << 20
+
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+type StreamOptions struct {
+	// Compression applies to writing. Reading detects it.
+	Compression Compression
+	// Progress, when set, is called with the number of uncompressed bytes
+	// written or read so far, every MiB or so and once at the end.
+	Progress func(n int64)
+}
+
+// WriteTo writes an uncompressed snapshot of the service to w. Like Save, it
+// lets searches run and makes Put and Delete wait.
+func (s *Service) WriteTo(w io.Writer) (int64, error) {
+	return s.WriteToWithOptions(w, StreamOptions{})
+}
+
+// WriteToWithOptions is WriteTo with compression and progress reporting. It
+// returns the number of bytes written to w, after compression.
+func (s *Service) WriteToWithOptions(w io.Writer, opts StreamOptions) (int64, error) {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	s.indexMtx.RLock()
+	defer s.indexMtx.RUnlock()
+
+	out := &countWriter{w: w}
+	var compressor io.WriteCloser
+	switch opts.Compression {
+	case CompressionGzip:
+		compressor = gzip.NewWriter(out)
+	case CompressionZstd:
+		enc, err := zstd.NewWriter(out)
+		if err != nil {
+			return 0, err
+		}
+		compressor = enc
+	}
+
+	var bw *bufio.Writer
+	if compressor != nil {
+		bw = bufio.NewWriter(compressor)
+	} else {
+		bw = bufio.NewWriter(out)
+	}
+	hash := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(bw, hash), progress: opts.Progress, next: progressInterval}
+
+	err := s.writeStreamUnsafe(cw)
+	if err == nil {
+		_, err = bw.Write(hash.Sum(nil))
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if compressor != nil {
+		if closeErr := compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return out.n, streamError(err)
+	}
+
+	if cw.progress != nil {
+		cw.progress(cw.n)
+	}
+	return out.n, nil
+}
+
+func (s *Service) writeStreamUnsafe(w io.Writer) error {
+	if _, err := io.WriteString(w, streamMagic); err != nil {
+		return err
+	}
+
+	m := s.manifestUnsafe()
+	data, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+	if err := writeSection(w, data); err != nil {
+		return err
+	}
+
+	if _, err := s.h.WriteTo(w); err != nil {
+		return err
+	}
+
+	if err := s.writeLabelsUnsafe(w); err != nil {
+		return err
+	}
+
+	var md bytes.Buffer
+	if err := s.writeMetadataUnsafe(&md); err != nil {
+		return err
+	}
+	return writeSection(w, md.Bytes())
+}
+
+// ReadFrom restores a service from a stream written by WriteTo, compressed
+// or not. cfg is checked as by Load.
+func ReadFrom(r io.Reader, cfg *Configuration) (*Service, error) {
+	return ReadFromWithOptions(r, cfg, StreamOptions{})
+}
+
+// ReadFromWithOptions is ReadFrom with progress reporting. opts.Compression
+// is ignored. r is read past the end of the stream.
+func ReadFromWithOptions(r io.Reader, cfg *Configuration, opts StreamOptions) (*Service, error) {
+	br := bufio.NewReader(r)
+	// a stream too short to peek fails on the magic string below
+	head, _ := br.Peek(len(zstdMagic))
+
+	var src *bufio.Reader = br
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, streamError(err)
+		}
+		defer zr.Close()
+		src = bufio.NewReader(zr)
+	case bytes.HasPrefix(head, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, streamError(err)
+		}
+		defer zr.Close()
+		src = bufio.NewReader(zr)
+	}
+
+	hash := sha256.New()
+	cr := &countReader{r: io.TeeReader(src, hash), progress: opts.Progress, next: progressInterval}
+
+	s, err := readStream(cr, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(src, sum); err != nil {
+		s.h.Free()
+		return nil, streamError(err)
+	}
+	if !bytes.Equal(sum, hash.Sum(nil)) {
+		s.h.Free()
+		return nil, fmt.Errorf("%w: stream", ErrSnapshotChecksum)
+	}
+	// the decompressor checks its own trailer at the end of the data
+	if src != br {
+		if _, err := src.ReadByte(); err != io.EOF {
+			s.h.Free()
+			if err == nil {
+				err = errors.New("data past the end of the snapshot")
+			}
+			return nil, streamError(err)
+		}
+	}
+
+	if cr.progress != nil {
+		cr.progress(cr.n)
+	}
+	return s, nil
+}
+
+func readStream(r io.Reader, cfg *Configuration) (*Service, error) {
+	magic := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, streamError(err)
+	}
+	if string(magic) != streamMagic {
+		return nil, fmt.Errorf("%w: not a snapshot stream", ErrIO)
+	}
+
+	data, err := readSection(r)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: manifest: %v", ErrIO, err)
+	}
+	// streams started with version 2
+	if m.Version != snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSnapshotVersion, m.Version)
+	}
+	if !m.matches(cfg) {
+		return nil, ErrSnapshotMismatch
+	}
+
+	var h index
+	if m.Exact {
+		h, err = hnswgo.ReadBruteforce(r, m.Dim, string(m.SpaceType))
+	} else {
+		h, err = hnswgo.ReadFrom(r, m.Dim, string(m.SpaceType))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := m.newService(cfg, h)
+
+	if err := s.readLabels(r); err != nil {
+		h.Free()
+		return nil, err
+	}
+
+	data, err = readSection(r)
+	if err != nil {
+		h.Free()
+		return nil, err
+	}
+	if err := s.readMetadata(data); err != nil {
+		h.Free()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func writeSection(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readSection(r io.Reader) ([]byte, error) {
+	var size uint64
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, streamError(err)
+	}
+	// a corrupt size must not allocate more than the stream holds
+	data, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, streamError(err)
+	}
+	if uint64(len(data)) != size {
+		return nil, streamError(io.ErrUnexpectedEOF)
+	}
+	return data, nil
+}
+
+// streamError makes err an ErrIO unless it is one already.
+func streamError(err error) error {
+	if errors.Is(err, ErrIO) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrIO, err)
+}
+
+// countWriter and countReader count the bytes passing through, calling
+// progress every progressInterval bytes when set.
+type countWriter struct {
+	w        io.Writer
+	n        int64
+	next     int64
+	progress func(n int64)
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	if cw.progress != nil && cw.n >= cw.next {
+		cw.progress(cw.n)
+		cw.next = cw.n + progressInterval
+	}
+	return n, err
+}
+
+type countReader struct {
+	r        io.Reader
+	n        int64
+	next     int64
+	progress func(n int64)
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	if cr.progress != nil && cr.n >= cr.next {
+		cr.progress(cr.n)
+		cr.next = cr.n + progressInterval
+	}
+	return n, err
+}
@@ -0,0 +1,342 @@
+package graph
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	hnswgo "github.com/abilitylab/graph/pkg/hnsw"
+)
+
+var ErrTuneTarget = errors.New("graph: tune target sets neither Recall nor P99")
+
+const (
+	defaultTuneK          = 10
+	defaultTuneSampleSize = 100
+	defaultTuneMaxEF      = 1024
+	defaultRetuneGrowth   = 0.2
+
+	// autoTuneMinPoints is the size below which automatic tuning waits; a
+	// smaller index answers well with any ef.
+	autoTuneMinPoints = 1000
+)
+
+// TuneTarget is what TuneEF aims for. With Recall set it picks the smallest
+// ef reaching it, with P99 alone the largest ef staying within it. With both,
+// P99 is a hard limit: when no ef within it reaches Recall, the largest one
+// within it is picked and the result is reported as not met.
+type TuneTarget struct {
+	// K is the k of recall@k and of the timed searches. Zero means 10.
+	K int
+	// Recall is the mean recall@K to reach.
+	Recall float64
+	// P99 is the 99th percentile search latency not to exceed.
+	P99 time.Duration
+	// SampleSize is the number of stored vectors searched for at each ef.
+	// Zero means 100.
+	SampleSize int
+	// MaxEF bounds the ef tried. Zero means 1024.
+	MaxEF int
+}
+
+// TuneResult reports an ef chosen by TuneEF and what it measured.
+type TuneResult struct {
+	EF     int           `json:"ef"`
+	Recall float64       `json:"recall"`
+	P99    time.Duration `json:"p99"`
+	// Met is false when no ef tried reached the target.
+	Met bool `json:"met"`
+	// Count is the number of stored points at calibration.
+	Count int `json:"count"`
+}
+
+type tuner struct {
+	target   *TuneTarget
+	growth   float64
+	onTune   func(TuneResult)
+	busy     chan struct{}
+	mtx      sync.Mutex
+	next     int
+	result   TuneResult
+	resultOK bool
+}
+
+func logTune(r TuneResult) {
+	log.Printf("graph: ef tuned to %d on %d points, recall %.3f, p99 %s, target met: %t", r.EF, r.Count, r.Recall, r.P99, r.Met)
+}
+
+// TunedEF returns the result of the last tuning, automatic or not.
+func (s *Service) TunedEF() (TuneResult, bool) {
+	s.tune.mtx.Lock()
+	defer s.tune.mtx.Unlock()
+
+	return s.tune.result, s.tune.resultOK
+}
+
+// TuneEF searches a sample of stored vectors at increasing ef, sets the ef
+// that best fits target with SetEF and returns it. Each sampled vector is
+// left out of its own results.
+func (s *Service) TuneEF(target TuneTarget) (TuneResult, error) {
+	if target.Recall <= 0 && target.P99 <= 0 {
+		return TuneResult{}, ErrTuneTarget
+	}
+	k := target.K
+	if k <= 0 {
+		k = defaultTuneK
+	}
+	sampleSize := target.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = defaultTuneSampleSize
+	}
+	maxEF := target.MaxEF
+	if maxEF <= 0 {
+		maxEF = defaultTuneMaxEF
+	}
+
+	// points put during calibration are dropped from the results, as the
+	// exact results do not hold them
+	queries, stored := s.sampleQueries(sampleSize)
+	count := len(stored)
+	var maxInnerLabel uint32
+	for _, innerLabel := range stored {
+		if innerLabel > maxInnerLabel {
+			maxInnerLabel = innerLabel
+		}
+	}
+	isStored := hnswgo.NewBitset(maxInnerLabel + 1)
+	for _, innerLabel := range stored {
+		isStored.Set(innerLabel)
+	}
+
+	exact := make([][]uint32, len(queries))
+	for i, q := range queries {
+		s.indexMtx.RLock()
+		innerLabels, _, err := s.h.SearchKNNAmong(q.vector, k+1, stored)
+		s.indexMtx.RUnlock()
+		if err != nil {
+			return TuneResult{}, err
+		}
+		exact[i] = withoutLabel(innerLabels, q.innerLabel, k)
+	}
+
+	measure := func(ef int) (TuneResult, error) {
+		var (
+			hits, total int
+			latencies   = make([]time.Duration, len(queries))
+		)
+		for i, q := range queries {
+			s.indexMtx.RLock()
+			start := time.Now()
+			innerLabels, _, err := s.h.SearchKNNWithEf(q.vector, k+1, ef)
+			latencies[i] = time.Since(start)
+			s.indexMtx.RUnlock()
+			if err != nil {
+				return TuneResult{}, err
+			}
+
+			// points put since sampling push stored ones out of the results;
+			// what is left is scored against as many exact neighbours
+			found := withoutLabel(storedLabels(innerLabels, isStored), q.innerLabel, k)
+			want := exact[i]
+			if len(found) < len(want) {
+				want = want[:len(found)]
+			}
+			hits += len(intersectLabels(found, want))
+			total += len(want)
+		}
+
+		r := TuneResult{EF: ef, Recall: 1, P99: percentile(latencies, 0.99), Count: count}
+		if total > 0 {
+			r.Recall = float64(hits) / float64(total)
+		}
+		r.Met = (target.Recall <= 0 || r.Recall >= target.Recall) && (target.P99 <= 0 || r.P99 <= target.P99)
+		return r, nil
+	}
+
+	// double ef until the target is reached or the latency limit passed,
+	// then bisect between the last two values tried
+	var best, last TuneResult
+	for ef := k; ; ef *= 2 {
+		if ef > maxEF {
+			ef = maxEF
+		}
+
+		r, err := measure(ef)
+		if err != nil {
+			return TuneResult{}, err
+		}
+
+		if target.P99 > 0 && r.P99 > target.P99 {
+			if best.EF == 0 {
+				best = r
+			}
+			break
+		}
+		if target.Recall > 0 && r.Recall >= target.Recall {
+			best, err = bisectEF(last, r, measure)
+			if err != nil {
+				return TuneResult{}, err
+			}
+			break
+		}
+
+		best, last = r, r
+		if ef == maxEF {
+			break
+		}
+	}
+
+	s.SetEF(best.EF)
+
+	s.tune.mtx.Lock()
+	s.tune.result, s.tune.resultOK = best, true
+	s.tune.mtx.Unlock()
+
+	return best, nil
+}
+
+// bisectEF narrows down the smallest ef meeting the target between failing,
+// which does not, and passing, which does, to within an eighth of failing.
+func bisectEF(failing, passing TuneResult, measure func(ef int) (TuneResult, error)) (TuneResult, error) {
+	for failing.EF > 0 && passing.EF-failing.EF > failing.EF/8+1 {
+		r, err := measure((failing.EF + passing.EF) / 2)
+		if err != nil {
+			return TuneResult{}, err
+		}
+		if r.Met {
+			passing = r
+		} else {
+			failing = r
+		}
+	}
+	return passing, nil
+}
+
+// maybeRetuneUnsafe starts a background TuneEF with Configuration.Tune once
+// the index has grown by RetuneGrowth since the last one. The caller holds
+// rwMtx.
+func (s *Service) maybeRetuneUnsafe() {
+	if s.tune.target == nil {
+		return
+	}
+
+	count := len(s.labelOuterMap)
+
+	s.tune.mtx.Lock()
+	defer s.tune.mtx.Unlock()
+
+	if count < s.tune.next {
+		return
+	}
+	select {
+	case s.tune.busy <- struct{}{}:
+	default:
+		return
+	}
+	s.tune.next = int(float64(count) * (1 + s.tune.growth))
+
+	go func() {
+		defer func() { <-s.tune.busy }()
+
+		r, err := s.TuneEF(*s.tune.target)
+		if err != nil {
+			log.Printf("graph: ef tuning: %v", err)
+			return
+		}
+		s.tune.onTune(r)
+	}()
+}
+
+type tuneQuery struct {
+	innerLabel uint32
+	vector     []float32
+}
+
+// sampleQueries picks up to n stored points at random. It returns them with
+// the inner labels of all stored points.
+func (s *Service) sampleQueries(n int) ([]tuneQuery, []uint32) {
+	s.rwMtx.RLock()
+	innerLabels := make([]uint32, 0, len(s.labelOuterMap))
+	for innerLabel := range s.labelOuterMap {
+		innerLabels = append(innerLabels, innerLabel)
+	}
+	s.rwMtx.RUnlock()
+
+	count := len(innerLabels)
+	if n > count {
+		n = count
+	}
+	for i := 0; i < n; i++ {
+		j := i + rand.Intn(count-i)
+		innerLabels[i], innerLabels[j] = innerLabels[j], innerLabels[i]
+	}
+
+	s.indexMtx.RLock()
+	defer s.indexMtx.RUnlock()
+
+	queries := make([]tuneQuery, 0, n)
+	for _, innerLabel := range innerLabels[:n] {
+		vector, err := s.h.GetDataByLabel(innerLabel)
+		if err != nil {
+			// deleted since it was listed
+			continue
+		}
+		queries = append(queries, tuneQuery{innerLabel: innerLabel, vector: vector})
+	}
+
+	return queries, innerLabels
+}
+
+// withoutLabel drops innerLabel from innerLabels, keeping at most k.
+func withoutLabel(innerLabels []uint32, innerLabel uint32, k int) []uint32 {
+	out := make([]uint32, 0, k)
+	for _, l := range innerLabels {
+		if l != innerLabel && len(out) < k {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// storedLabels drops the labels not in stored, in place.
+func storedLabels(innerLabels []uint32, stored hnswgo.Bitset) []uint32 {
+	out := innerLabels[:0]
+	for _, l := range innerLabels {
+		if stored.Has(l) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func intersectLabels(a, b []uint32) []uint32 {
+	set := make(map[uint32]struct{}, len(b))
+	for _, l := range b {
+		set[l] = struct{}{}
+	}
+	var out []uint32
+	for _, l := range a {
+		if _, found := set[l]; found {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
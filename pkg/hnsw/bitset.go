@@ -0,0 +1,44 @@
+package hnswgo
+
+import "math/bits"
+
+// Bitset is an allow list of labels for filtered searches: label i is allowed
+// when bit i%64 of word i/64 is set.
+type Bitset []uint64
+
+func NewBitset(size uint32) Bitset {
+	return make(Bitset, (uint64(size)+63)/64)
+}
+
+// bitsetOf returns a bitset allowing exactly labels.
+func bitsetOf(labels []uint32) Bitset {
+	var max uint32
+	for _, label := range labels {
+		if label > max {
+			max = label
+		}
+	}
+	b := NewBitset(max + 1)
+	for _, label := range labels {
+		b.Set(label)
+	}
+	return b
+}
+
+// Set allows label. The bitset must have been created large enough for it.
+func (b Bitset) Set(label uint32) {
+	b[label/64] |= 1 << (label % 64)
+}
+
+func (b Bitset) Has(label uint32) bool {
+	word := label / 64
+	return int(word) < len(b) && b[word]&(1<<(label%64)) != 0
+}
+
+func (b Bitset) Count() int {
+	count := 0
+	for _, word := range b {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
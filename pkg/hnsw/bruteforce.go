@@ -0,0 +1,274 @@
+//go:build cgo && !purego
+
+package hnswgo
+
+// #include <stdlib.h>
+// #include "hnsw_wrapper.h"
+import "C"
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// Bruteforce is an exact index backed by hnswlib's BruteforceSearch, with
+// the same calls as HNSW.
+type Bruteforce struct {
+	index     C.Bruteforce
+	spaceType string
+	dim       int
+	normalize bool
+	mtx       sync.RWMutex
+}
+
+func NewBruteforce(dim int, maxElements uint32, spaceType string) (*Bruteforce, error) {
+	var cerr C.HNSWError
+	stype, normalize := spaceChar(spaceType)
+	index := C.initBruteforce(C.int(dim), C.ulong(maxElements), stype, &cerr)
+	if index == nil {
+		return nil, newError(&cerr)
+	}
+	return &Bruteforce{index: index, spaceType: spaceType, dim: dim, normalize: normalize}, nil
+}
+
+func LoadBruteforce(location string, dim int, spaceType string) (*Bruteforce, error) {
+	var cerr C.HNSWError
+	stype, normalize := spaceChar(spaceType)
+	pLocation := C.CString(location)
+	index := C.loadBruteforce(pLocation, C.int(dim), stype, &cerr)
+	C.free(unsafe.Pointer(pLocation))
+	if index == nil {
+		return nil, newError(&cerr)
+	}
+	return &Bruteforce{index: index, spaceType: spaceType, dim: dim, normalize: normalize}, nil
+}
+
+func (b *Bruteforce) Save(location string) error {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	var cerr C.HNSWError
+	pLocation := C.CString(location)
+	defer C.free(unsafe.Pointer(pLocation))
+	if C.saveBruteforce(b.index, pLocation, &cerr) != C.HNSW_OK {
+		return newError(&cerr)
+	}
+	return nil
+}
+
+// WriteTo writes the index to w in the format Save writes to a file.
+func (b *Bruteforce) WriteTo(w io.Writer) (int64, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	hdr := bruteforceHeader{
+		MaxElements:    uint64(C.getBruteforceMaxElements(b.index)),
+		SizePerElement: uint64(b.dim)*4 + 8,
+		Count:          uint64(C.getBruteforceCount(b.index)),
+	}
+	cw := countWriter{w: w}
+	cw.writeValue(&hdr)
+	cw.writeChunked(unsafe.Slice((*byte)(unsafe.Pointer(C.getBruteforceData(b.index))), hdr.MaxElements*hdr.SizePerElement))
+	return cw.result()
+}
+
+// ReadBruteforce reads an index in the format Save writes, as LoadBruteforce
+// does from a file. It reads exactly the index from r, nothing past it.
+func ReadBruteforce(r io.Reader, dim int, spaceType string) (*Bruteforce, error) {
+	var hdr bruteforceHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, readError(err)
+	}
+	if err := hdr.check(dim); err != nil {
+		return nil, err
+	}
+
+	b, err := NewBruteforce(dim, uint32(hdr.MaxElements), spaceType)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.MaxElements > 0 {
+		data := unsafe.Slice((*byte)(unsafe.Pointer(C.getBruteforceData(b.index))), hdr.MaxElements*hdr.SizePerElement)
+		if _, err := io.ReadFull(r, data); err != nil {
+			b.Free()
+			return nil, readError(err)
+		}
+	}
+	var cerr C.HNSWError
+	if C.finishBruteforce(b.index, C.ulong(hdr.Count), &cerr) != C.HNSW_OK {
+		b.Free()
+		return nil, newError(&cerr)
+	}
+	return b, nil
+}
+
+func (b *Bruteforce) Free() {
+	C.freeBruteforce(b.index)
+}
+
+func (b *Bruteforce) AddPoint(vector []float32, label uint32) error {
+	if len(vector) != b.dim {
+		return ErrDimensionMismatch
+	}
+	if b.normalize {
+		vector = normalizeVector(vector)
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var cerr C.HNSWError
+	if C.bruteforceAddPoint(b.index, (*C.float)(unsafe.Pointer(&vector[0])), C.ulong(label), &cerr) != C.HNSW_OK {
+		return newError(&cerr)
+	}
+	return nil
+}
+
+// AddPoints is HNSW.AddPoints. Adding a vector is a copy, so it runs on the
+// calling thread whatever threads says.
+func (b *Bruteforce) AddPoints(vectors [][]float32, labels []uint32, threads int) ([]ErrorCode, error) {
+	if len(vectors) != len(labels) {
+		return nil, &Error{Code: CodeUnknown, Message: "vectors and labels differ in length"}
+	}
+	var (
+		codes    []ErrorCode
+		firstErr error
+	)
+	for i, vector := range vectors {
+		err := b.AddPoint(vector, labels[i])
+		if err == nil {
+			continue
+		}
+		if codes == nil {
+			codes = make([]ErrorCode, len(vectors))
+			firstErr = err
+		}
+		codes[i] = CodeUnknown
+		if e, ok := err.(*Error); ok {
+			codes[i] = e.Code
+		}
+	}
+	return codes, firstErr
+}
+
+func (b *Bruteforce) SearchKNN(vector []float32, N int) ([]uint32, []float32, error) {
+	return b.search(vector, N, nil)
+}
+
+// SearchKNNWithEf is SearchKNN; an exact search has no ef.
+func (b *Bruteforce) SearchKNNWithEf(vector []float32, N int, ef int) ([]uint32, []float32, error) {
+	return b.search(vector, N, nil)
+}
+
+// SearchKNNFiltered is SearchKNN returning only labels set in allow.
+func (b *Bruteforce) SearchKNNFiltered(vector []float32, N int, ef int, allow Bitset) ([]uint32, []float32, error) {
+	if len(allow) == 0 {
+		return nil, nil, nil
+	}
+	return b.search(vector, N, allow)
+}
+
+// SearchKNNExact is SearchKNN.
+func (b *Bruteforce) SearchKNNExact(vector []float32, N int) ([]uint32, []float32, error) {
+	return b.search(vector, N, nil)
+}
+
+// SearchKNNAmong is SearchKNN over the given labels only.
+func (b *Bruteforce) SearchKNNAmong(vector []float32, N int, candidates []uint32) ([]uint32, []float32, error) {
+	return b.SearchKNNFiltered(vector, N, 0, bitsetOf(candidates))
+}
+
+func (b *Bruteforce) search(vector []float32, N int, allow Bitset) ([]uint32, []float32, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	var (
+		Callow *C.uint64_t
+		words  = C.ulong(len(allow))
+	)
+	if len(allow) > 0 {
+		Callow = (*C.uint64_t)(unsafe.Pointer(&allow[0]))
+	}
+	return searchKNN(b.dim, b.normalize, vector, N, func(v *C.float, label *C.ulong, dist *C.float, cerr *C.HNSWError) C.int {
+		return C.bruteforceSearchKnn(b.index, v, C.int(N), Callow, words, label, dist, cerr)
+	})
+}
+
+// SearchKNNBatch is HNSW.SearchKNNBatch.
+func (b *Bruteforce) SearchKNNBatch(vectors [][]float32, N int, threads int) ([][]uint32, [][]float32, error) {
+	if len(vectors) == 0 || N <= 0 {
+		return make([][]uint32, len(vectors)), make([][]float32, len(vectors)), nil
+	}
+	flat, err := flatten(b.dim, b.normalize, vectors)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	Clabel := make([]C.ulong, len(vectors)*N)
+	Cdist := make([]C.float, len(vectors)*N)
+	Ccount := make([]C.int, len(vectors))
+	var cerr C.HNSWError
+	if C.bruteforceSearchKnnBatch(b.index, (*C.float)(unsafe.Pointer(&flat[0])), C.ulong(len(vectors)), C.int(N), C.int(threads), &Clabel[0], &Cdist[0], &Ccount[0], &cerr) != C.HNSW_OK {
+		return nil, nil, newError(&cerr)
+	}
+	labels, dists := batchResults(Clabel, Cdist, Ccount, N)
+	return labels, dists, nil
+}
+
+// SetEf does nothing; an exact search has no ef.
+func (b *Bruteforce) SetEf(ef int) {}
+
+// MarkDelete removes the point with the given label. Unlike HNSW, its slot is
+// freed for the next point.
+func (b *Bruteforce) MarkDelete(label uint32) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var cerr C.HNSWError
+	if C.bruteforceRemovePoint(b.index, C.ulong(label), &cerr) != C.HNSW_OK {
+		return newError(&cerr)
+	}
+	return nil
+}
+
+func (b *Bruteforce) Resize(maxElements uint32) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var cerr C.HNSWError
+	if C.bruteforceResize(b.index, C.ulong(maxElements), &cerr) != C.HNSW_OK {
+		return newError(&cerr)
+	}
+	return nil
+}
+
+func (b *Bruteforce) MaxElements() uint32 {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	return uint32(C.getBruteforceMaxElements(b.index))
+}
+
+// Len returns the number of stored points.
+func (b *Bruteforce) Len() uint32 {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	return uint32(C.getBruteforceCount(b.index))
+}
+
+func (b *Bruteforce) GetDataByLabel(label uint32) ([]float32, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	vector := make([]float32, b.dim)
+	var cerr C.HNSWError
+	if C.bruteforceGetDataByLabel(b.index, C.ulong(label), (*C.float)(unsafe.Pointer(&vector[0])), &cerr) != C.HNSW_OK {
+		return nil, newError(&cerr)
+	}
+	return vector, nil
+}
@@ -0,0 +1,329 @@
+//go:build !cgo || purego
+
+package hnswgo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+// Bruteforce is the Go counterpart of hnswlib's BruteforceSearch, with the
+// same file format and the same calls as HNSW.
+type Bruteforce struct {
+	spaceType string
+	dim       int
+	normalize bool
+	distance  func(a, b []float32) float32
+
+	mtx         sync.RWMutex
+	maxElements uint32
+	// vectors holds dim floats per element; removing an element moves the
+	// last one into its place
+	vectors []float32
+	labels  []uint32
+	index   map[uint32]int
+}
+
+func NewBruteforce(dim int, maxElements uint32, spaceType string) (*Bruteforce, error) {
+	if maxElements == 0 {
+		maxElements = 1
+	}
+	distance, normalize := newSpace(spaceType)
+	return &Bruteforce{
+		spaceType:   spaceType,
+		dim:         dim,
+		normalize:   normalize,
+		distance:    distance,
+		maxElements: maxElements,
+		index:       make(map[uint32]int),
+	}, nil
+}
+
+func LoadBruteforce(location string, dim int, spaceType string) (*Bruteforce, error) {
+	f, err := os.Open(location)
+	if err != nil {
+		return nil, errOpenFile
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	b, err := ReadBruteforce(r, dim, spaceType)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		return nil, errCorrupted
+	}
+	return b, nil
+}
+
+// ReadBruteforce reads an index in the format Save writes, as LoadBruteforce
+// does from a file. It reads exactly the index from r, nothing past it.
+func ReadBruteforce(r io.Reader, dim int, spaceType string) (*Bruteforce, error) {
+	var hdr bruteforceHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, readError(err)
+	}
+	if err := hdr.check(dim); err != nil {
+		return nil, err
+	}
+
+	b, _ := NewBruteforce(dim, uint32(hdr.MaxElements), spaceType)
+	rec := make([]byte, hdr.SizePerElement)
+	for i := uint64(0); i < hdr.MaxElements; i++ {
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return nil, readError(err)
+		}
+		if i >= hdr.Count {
+			continue
+		}
+		for j := 0; j < dim; j++ {
+			b.vectors = append(b.vectors, math.Float32frombits(binary.LittleEndian.Uint32(rec[4*j:])))
+		}
+		label := binary.LittleEndian.Uint64(rec[4*dim:])
+		if label > math.MaxUint32 {
+			return nil, errCorrupted
+		}
+		b.index[uint32(label)] = len(b.labels)
+		b.labels = append(b.labels, uint32(label))
+	}
+	return b, nil
+}
+
+func (b *Bruteforce) Save(location string) error {
+	f, err := os.Create(location)
+	if err != nil {
+		return errOpenFile
+	}
+	return writeFile(f, b)
+}
+
+// WriteTo writes the index to w in the format Save writes to a file.
+func (b *Bruteforce) WriteTo(w io.Writer) (int64, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	sizePerElement := b.dim*4 + 8
+	cw := countWriter{w: w}
+	cw.writeValue(&bruteforceHeader{
+		MaxElements:    uint64(b.maxElements),
+		SizePerElement: uint64(sizePerElement),
+		Count:          uint64(len(b.labels)),
+	})
+
+	var buf []byte
+	for i, label := range b.labels {
+		for _, x := range b.vector(i) {
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(x))
+		}
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(label))
+		if len(buf) >= streamChunk {
+			cw.Write(buf)
+			buf = buf[:0]
+		}
+	}
+	cw.Write(buf)
+
+	// unused records are zeros
+	zeros := make([]byte, minInt(streamChunk, (int(b.maxElements)-len(b.labels))*sizePerElement))
+	for n := (int(b.maxElements) - len(b.labels)) * sizePerElement; n > 0 && cw.err == nil; n -= len(zeros) {
+		cw.Write(zeros[:minInt(n, len(zeros))])
+	}
+
+	return cw.result()
+}
+
+// Free drops the index data. The index must not be used afterwards.
+func (b *Bruteforce) Free() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.vectors, b.labels, b.index = nil, nil, nil
+}
+
+func (b *Bruteforce) vector(i int) []float32 {
+	return b.vectors[i*b.dim : (i+1)*b.dim]
+}
+
+func (b *Bruteforce) AddPoint(vector []float32, label uint32) error {
+	if len(vector) != b.dim {
+		return ErrDimensionMismatch
+	}
+	if b.normalize {
+		vector = normalizeVector(vector)
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.addPointUnsafe(vector, label)
+}
+
+func (b *Bruteforce) addPointUnsafe(vector []float32, label uint32) error {
+	if i, found := b.index[label]; found {
+		copy(b.vector(i), vector)
+		return nil
+	}
+	if uint32(len(b.labels)) >= b.maxElements {
+		return errCapacity
+	}
+	b.index[label] = len(b.labels)
+	b.labels = append(b.labels, label)
+	b.vectors = append(b.vectors, vector...)
+	return nil
+}
+
+// AddPoints is HNSW.AddPoints. Adding a vector is a copy, so it runs on the
+// calling goroutine whatever threads says.
+func (b *Bruteforce) AddPoints(vectors [][]float32, labels []uint32, threads int) ([]ErrorCode, error) {
+	if len(vectors) != len(labels) {
+		return nil, &Error{Code: CodeUnknown, Message: "vectors and labels differ in length"}
+	}
+	flat, err := flatten(b.dim, b.normalize, vectors)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var (
+		codes    []ErrorCode
+		firstErr error
+	)
+	for i, label := range labels {
+		err := b.addPointUnsafe(flat[i*b.dim:(i+1)*b.dim], label)
+		if err == nil {
+			continue
+		}
+		if codes == nil {
+			codes = make([]ErrorCode, len(labels))
+			firstErr = err
+		}
+		codes[i] = err.(*Error).Code
+	}
+	return codes, firstErr
+}
+
+func (b *Bruteforce) SearchKNN(vector []float32, N int) ([]uint32, []float32, error) {
+	return b.search(vector, N, nil)
+}
+
+// SearchKNNWithEf is SearchKNN; an exact search has no ef.
+func (b *Bruteforce) SearchKNNWithEf(vector []float32, N int, ef int) ([]uint32, []float32, error) {
+	return b.search(vector, N, nil)
+}
+
+// SearchKNNFiltered is SearchKNN returning only labels set in allow.
+func (b *Bruteforce) SearchKNNFiltered(vector []float32, N int, ef int, allow Bitset) ([]uint32, []float32, error) {
+	if len(allow) == 0 {
+		return nil, nil, nil
+	}
+	return b.search(vector, N, allow)
+}
+
+// SearchKNNExact is SearchKNN.
+func (b *Bruteforce) SearchKNNExact(vector []float32, N int) ([]uint32, []float32, error) {
+	return b.search(vector, N, nil)
+}
+
+// SearchKNNAmong is SearchKNN over the given labels only.
+func (b *Bruteforce) SearchKNNAmong(vector []float32, N int, candidates []uint32) ([]uint32, []float32, error) {
+	return b.SearchKNNFiltered(vector, N, 0, bitsetOf(candidates))
+}
+
+func (b *Bruteforce) search(vector []float32, N int, allow Bitset) ([]uint32, []float32, error) {
+	if len(vector) != b.dim {
+		return nil, nil, ErrDimensionMismatch
+	}
+	if N <= 0 {
+		return nil, nil, nil
+	}
+	if b.normalize {
+		vector = normalizeVector(vector)
+	}
+
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	top := candidateHeap{max: true}
+	for i, label := range b.labels {
+		if allow != nil && !allow.Has(label) {
+			continue
+		}
+		top.pushBounded(candidate{id: label, dist: b.distance(vector, b.vector(i))}, N)
+	}
+	labels, dists := top.split()
+	return labels, dists, nil
+}
+
+// SearchKNNBatch is HNSW.SearchKNNBatch.
+func (b *Bruteforce) SearchKNNBatch(vectors [][]float32, N int, threads int) ([][]uint32, [][]float32, error) {
+	return searchBatch(len(vectors), threads, func(i int) ([]uint32, []float32, error) {
+		return b.SearchKNN(vectors[i], N)
+	})
+}
+
+// SetEf does nothing; an exact search has no ef.
+func (b *Bruteforce) SetEf(ef int) {}
+
+// MarkDelete removes the point with the given label. Unlike HNSW, its slot is
+// freed for the next point.
+func (b *Bruteforce) MarkDelete(label uint32) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	i, found := b.index[label]
+	if !found {
+		return errLabelNotFound
+	}
+	last := len(b.labels) - 1
+	copy(b.vector(i), b.vector(last))
+	b.labels[i] = b.labels[last]
+	b.index[b.labels[i]] = i
+	delete(b.index, label)
+	b.labels = b.labels[:last]
+	b.vectors = b.vectors[:last*b.dim]
+	return nil
+}
+
+func (b *Bruteforce) Resize(maxElements uint32) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if maxElements < uint32(len(b.labels)) {
+		return errResize
+	}
+	b.maxElements = maxElements
+	return nil
+}
+
+func (b *Bruteforce) MaxElements() uint32 {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	return b.maxElements
+}
+
+// Len returns the number of stored points.
+func (b *Bruteforce) Len() uint32 {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	return uint32(len(b.labels))
+}
+
+func (b *Bruteforce) GetDataByLabel(label uint32) ([]float32, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	i, found := b.index[label]
+	if !found {
+		return nil, errLabelNotFound
+	}
+	return append([]float32(nil), b.vector(i)...), nil
+}
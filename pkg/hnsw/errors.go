@@ -0,0 +1,39 @@
+package hnswgo
+
+type ErrorCode int
+
+// Codes up to CodeOutOfMemory mirror the HNSW_ERR_* values in hnsw_wrapper.h.
+const (
+	CodeUnknown ErrorCode = iota + 1
+	CodeCapacityExceeded
+	CodeUnknownLabel
+	CodeIO
+	CodeOutOfMemory
+	CodeDimensionMismatch
+)
+
+// Error is returned by every fallible HNSW call. Errors compare equal under
+// errors.Is when their codes match, so callers test against the sentinels
+// below rather than the message.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+var (
+	ErrUnknown           = &Error{Code: CodeUnknown, Message: "unknown error"}
+	ErrCapacityExceeded  = &Error{Code: CodeCapacityExceeded, Message: "capacity exceeded"}
+	ErrUnknownLabel      = &Error{Code: CodeUnknownLabel, Message: "unknown label"}
+	ErrIO                = &Error{Code: CodeIO, Message: "i/o failure"}
+	ErrOutOfMemory       = &Error{Code: CodeOutOfMemory, Message: "out of memory"}
+	ErrDimensionMismatch = &Error{Code: CodeDimensionMismatch, Message: "vector length is not equal to dim"}
+)
+
+func (e *Error) Error() string {
+	return "hnsw: " + e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
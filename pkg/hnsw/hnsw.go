@@ -1,3 +1,5 @@
+//go:build cgo && !purego
+
 package hnswgo
 
 // #cgo CFLAGS: -I./
@@ -6,11 +8,14 @@ package hnswgo
 // #include "hnsw_wrapper.h"
 import "C"
 import (
+	"encoding/binary"
+	"io"
 	"unsafe"
-
-	"github.com/chewxy/math32"
 )
 
+// HNSW wraps an hnswlib index. AddPoint, the searches, MarkDelete,
+// UnmarkDelete and GetDataByLabel may run concurrently with each other;
+// SetEf, Resize, Save and WriteTo must not run alongside any other call.
 type HNSW struct {
 	index     C.HNSW
 	spaceType string
@@ -18,84 +23,387 @@ type HNSW struct {
 	normalize bool
 }
 
-func New(dim, M, efConstruction, randSeed int, maxElements uint32, spaceType string) *HNSW {
+func newError(cerr *C.HNSWError) error {
+	return &Error{
+		Code:    ErrorCode(cerr.code),
+		Message: C.GoString(&cerr.message[0]),
+	}
+}
+
+// spaceChar maps a space type to the hnswlib space the wrapper builds, and
+// whether vectors are normalized on the way in. Cosine is inner product over
+// normalized vectors; anything unknown is l2.
+func spaceChar(spaceType string) (C.char, bool) {
+	switch spaceType {
+	case "ip":
+		return C.char('i'), false
+	case "cosine":
+		return C.char('i'), true
+	default:
+		return C.char('l'), false
+	}
+}
+
+func New(dim, M, efConstruction, randSeed int, maxElements uint32, spaceType string) (*HNSW, error) {
 	var hnsw HNSW
+	var cerr C.HNSWError
 	hnsw.dim = dim
 	hnsw.spaceType = spaceType
-	if spaceType == "ip" {
-		hnsw.index = C.initHNSW(C.int(dim), C.ulong(maxElements), C.int(M), C.int(efConstruction), C.int(randSeed), C.char('i'))
-	} else if spaceType == "cosine" {
-		hnsw.normalize = true
-		hnsw.index = C.initHNSW(C.int(dim), C.ulong(maxElements), C.int(M), C.int(efConstruction), C.int(randSeed), C.char('i'))
-	} else {
-		hnsw.index = C.initHNSW(C.int(dim), C.ulong(maxElements), C.int(M), C.int(efConstruction), C.int(randSeed), C.char('l'))
+	stype, normalize := spaceChar(spaceType)
+	hnsw.normalize = normalize
+	hnsw.index = C.initHNSW(C.int(dim), C.ulong(maxElements), C.int(M), C.int(efConstruction), C.int(randSeed), stype, &cerr)
+	if hnsw.index == nil {
+		return nil, newError(&cerr)
 	}
-	return &hnsw
+	return &hnsw, nil
 }
 
-func Load(location string, dim int, spaceType string) *HNSW {
+func Load(location string, dim int, spaceType string) (*HNSW, error) {
 	var hnsw HNSW
+	var cerr C.HNSWError
 	hnsw.dim = dim
 	hnsw.spaceType = spaceType
 
 	pLocation := C.CString(location)
-	if spaceType == "ip" {
-		hnsw.index = C.loadHNSW(pLocation, C.int(dim), C.char('i'))
-	} else if spaceType == "cosine" {
-		hnsw.normalize = true
-		hnsw.index = C.loadHNSW(pLocation, C.int(dim), C.char('i'))
-	} else {
-		hnsw.index = C.loadHNSW(pLocation, C.int(dim), C.char('l'))
-	}
+	stype, normalize := spaceChar(spaceType)
+	hnsw.normalize = normalize
+	hnsw.index = C.loadHNSW(pLocation, C.int(dim), stype, &cerr)
 	C.free(unsafe.Pointer(pLocation))
-	return &hnsw
+	if hnsw.index == nil {
+		return nil, newError(&cerr)
+	}
+	return &hnsw, nil
 }
 
-func (h *HNSW) Save(location string) {
+func (h *HNSW) Save(location string) error {
+	var cerr C.HNSWError
 	pLocation := C.CString(location)
-	C.saveHNSW(h.index, pLocation)
-	C.free(unsafe.Pointer(pLocation))
+	defer C.free(unsafe.Pointer(pLocation))
+	if C.saveHNSW(h.index, pLocation, &cerr) != C.HNSW_OK {
+		return newError(&cerr)
+	}
+	return nil
 }
 
-func (h *HNSW) Free() {
-	C.freeHNSW(h.index)
+// WriteTo writes the index to w in the format Save writes to a file. Nothing
+// is buffered: the level 0 records go out straight from the index memory.
+func (h *HNSW) WriteTo(w io.Writer) (int64, error) {
+	var chdr C.HNSWHeader
+	C.getHNSWHeader(h.index, &chdr)
+	hdr := indexHeader{
+		OffsetLevel0:   uint64(chdr.offset_level0),
+		MaxElements:    uint64(chdr.max_elements),
+		Count:          uint64(chdr.count),
+		SizePerElement: uint64(chdr.size_per_element),
+		LabelOffset:    uint64(chdr.label_offset),
+		OffsetData:     uint64(chdr.offset_data),
+		MaxLevel:       int32(chdr.max_level),
+		EntryPoint:     uint32(chdr.entry_point),
+		MaxM:           uint64(chdr.max_m),
+		MaxM0:          uint64(chdr.max_m0),
+		M:              uint64(chdr.m),
+		Mult:           float64(chdr.mult),
+		EFConstruction: uint64(chdr.ef_construction),
+	}
+
+	cw := countWriter{w: w}
+	cw.writeValue(&hdr)
+	if hdr.Count > 0 {
+		cw.writeChunked(unsafe.Slice((*byte)(unsafe.Pointer(C.getHNSWLevel0(h.index))), hdr.Count*hdr.SizePerElement))
+	}
+	for i := uint64(0); i < hdr.Count && cw.err == nil; i++ {
+		var size C.uint
+		links := C.getHNSWLinkList(h.index, C.ulong(i), &size)
+		cw.writeValue(uint32(size))
+		if size > 0 {
+			cw.Write(unsafe.Slice((*byte)(unsafe.Pointer(links)), size))
+		}
+	}
+	return cw.result()
+}
+
+// ReadFrom reads an index in the format Save writes, as Load does from a
+// file. It reads exactly the index from r, nothing past it.
+func ReadFrom(r io.Reader, dim int, spaceType string) (*HNSW, error) {
+	var hdr indexHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, readError(err)
+	}
+	if err := hdr.check(dim); err != nil {
+		return nil, err
+	}
+
+	chdr := C.HNSWHeader{
+		offset_level0:    C.uint64_t(hdr.OffsetLevel0),
+		max_elements:     C.uint64_t(hdr.MaxElements),
+		count:            C.uint64_t(hdr.Count),
+		size_per_element: C.uint64_t(hdr.SizePerElement),
+		label_offset:     C.uint64_t(hdr.LabelOffset),
+		offset_data:      C.uint64_t(hdr.OffsetData),
+		max_level:        C.int32_t(hdr.MaxLevel),
+		entry_point:      C.uint32_t(hdr.EntryPoint),
+		max_m:            C.uint64_t(hdr.MaxM),
+		max_m0:           C.uint64_t(hdr.MaxM0),
+		m:                C.uint64_t(hdr.M),
+		mult:             C.double(hdr.Mult),
+		ef_construction:  C.uint64_t(hdr.EFConstruction),
+	}
+	var cerr C.HNSWError
+	stype, normalize := spaceChar(spaceType)
+	h := &HNSW{spaceType: spaceType, dim: dim, normalize: normalize}
+	h.index = C.allocHNSW(&chdr, C.int(dim), stype, &cerr)
+	if h.index == nil {
+		return nil, newError(&cerr)
+	}
+
+	if err := h.readData(r, &hdr); err != nil {
+		h.Free()
+		return nil, err
+	}
+	return h, nil
 }
 
-func normalizeVector(vector []float32) []float32 {
-	var norm float32
-	for i := 0; i < len(vector); i++ {
-		norm += vector[i] * vector[i]
+func (h *HNSW) readData(r io.Reader, hdr *indexHeader) error {
+	if hdr.Count > 0 {
+		level0 := unsafe.Slice((*byte)(unsafe.Pointer(C.getHNSWLevel0(h.index))), hdr.Count*hdr.SizePerElement)
+		if _, err := io.ReadFull(r, level0); err != nil {
+			return readError(err)
+		}
 	}
-	norm = 1.0 / (math32.Sqrt(norm) + 1e-15)
-	for i := 0; i < len(vector); i++ {
-		vector[i] = vector[i] * norm
+
+	var cerr C.HNSWError
+	for i := uint64(0); i < hdr.Count; i++ {
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return readError(err)
+		}
+		if size == 0 {
+			continue
+		}
+		links := C.allocHNSWLinkList(h.index, C.ulong(i), C.uint(size), &cerr)
+		if links == nil {
+			return newError(&cerr)
+		}
+		if _, err := io.ReadFull(r, unsafe.Slice((*byte)(unsafe.Pointer(links)), size)); err != nil {
+			return readError(err)
+		}
+	}
+
+	if C.finishHNSW(h.index, &cerr) != C.HNSW_OK {
+		return newError(&cerr)
 	}
-	return vector
+	return nil
 }
 
-func (h *HNSW) AddPoint(vector []float32, label uint32) {
+func (h *HNSW) Free() {
+	C.freeHNSW(h.index)
+}
+
+func (h *HNSW) AddPoint(vector []float32, label uint32) error {
+	if len(vector) != h.dim {
+		return ErrDimensionMismatch
+	}
 	if h.normalize {
 		vector = normalizeVector(vector)
 	}
-	C.addPoint(h.index, (*C.float)(unsafe.Pointer(&vector[0])), C.ulong(label))
+	var cerr C.HNSWError
+	if C.addPoint(h.index, (*C.float)(unsafe.Pointer(&vector[0])), C.ulong(label), &cerr) != C.HNSW_OK {
+		return newError(&cerr)
+	}
+	return nil
 }
 
-func (h *HNSW) SearchKNN(vector []float32, N int) ([]uint32, []float32) {
-	Clabel := make([]C.ulong, N, N)
-	Cdist := make([]C.float, N, N)
-	if h.normalize {
+// AddPoints adds vectors[i] under labels[i] on threads threads, one per core
+// when threads is not positive. Points are added independently: on error,
+// codes[i] tells whether vectors[i] was added (ErrorCode 0) or why not.
+func (h *HNSW) AddPoints(vectors [][]float32, labels []uint32, threads int) ([]ErrorCode, error) {
+	if len(vectors) != len(labels) {
+		return nil, &Error{Code: CodeUnknown, Message: "vectors and labels differ in length"}
+	}
+	if len(vectors) == 0 {
+		return nil, nil
+	}
+	flat, err := flatten(h.dim, h.normalize, vectors)
+	if err != nil {
+		return nil, err
+	}
+	Clabels := make([]C.ulong, len(labels))
+	for i, label := range labels {
+		Clabels[i] = C.ulong(label)
+	}
+	Ccodes := make([]C.int, len(labels))
+	var cerr C.HNSWError
+	if C.addPoints(h.index, (*C.float)(unsafe.Pointer(&flat[0])), &Clabels[0], C.ulong(len(labels)), C.int(threads), &Ccodes[0], &cerr) != C.HNSW_OK {
+		codes := make([]ErrorCode, len(Ccodes))
+		for i, code := range Ccodes {
+			codes[i] = ErrorCode(code)
+		}
+		return codes, newError(&cerr)
+	}
+	return nil, nil
+}
+
+// SearchKNNBatch runs SearchKNN for every vector on threads threads, one per
+// core when threads is not positive.
+func (h *HNSW) SearchKNNBatch(vectors [][]float32, N int, threads int) ([][]uint32, [][]float32, error) {
+	if len(vectors) == 0 || N <= 0 {
+		return make([][]uint32, len(vectors)), make([][]float32, len(vectors)), nil
+	}
+	flat, err := flatten(h.dim, h.normalize, vectors)
+	if err != nil {
+		return nil, nil, err
+	}
+	Clabel := make([]C.ulong, len(vectors)*N)
+	Cdist := make([]C.float, len(vectors)*N)
+	Ccount := make([]C.int, len(vectors))
+	var cerr C.HNSWError
+	if C.searchKnnBatch(h.index, (*C.float)(unsafe.Pointer(&flat[0])), C.ulong(len(vectors)), C.int(N), C.int(threads), &Clabel[0], &Cdist[0], &Ccount[0], &cerr) != C.HNSW_OK {
+		return nil, nil, newError(&cerr)
+	}
+	labels, dists := batchResults(Clabel, Cdist, Ccount, N)
+	return labels, dists, nil
+}
+
+// batchResults splits the N-strided output of a batch search by query.
+func batchResults(Clabel []C.ulong, Cdist []C.float, Ccount []C.int, N int) ([][]uint32, [][]float32) {
+	labels := make([][]uint32, len(Ccount))
+	dists := make([][]float32, len(Ccount))
+	for i, count := range Ccount {
+		labels[i] = make([]uint32, count)
+		dists[i] = make([]float32, count)
+		for j := 0; j < int(count); j++ {
+			labels[i][j] = uint32(Clabel[i*N+j])
+			dists[i][j] = float32(Cdist[i*N+j])
+		}
+	}
+	return labels, dists
+}
+
+func (h *HNSW) SearchKNN(vector []float32, N int) ([]uint32, []float32, error) {
+	return searchKNN(h.dim, h.normalize, vector, N, func(v *C.float, label *C.ulong, dist *C.float, cerr *C.HNSWError) C.int {
+		return C.searchKnn(h.index, v, C.int(N), label, dist, cerr)
+	})
+}
+
+// SearchKNNWithEf is SearchKNN with the size of the dynamic candidate list
+// chosen for this call only. It leaves the ef set by SetEf alone, so
+// concurrent searches are unaffected. A non-positive ef means the SetEf value.
+func (h *HNSW) SearchKNNWithEf(vector []float32, N int, ef int) ([]uint32, []float32, error) {
+	return searchKNN(h.dim, h.normalize, vector, N, func(v *C.float, label *C.ulong, dist *C.float, cerr *C.HNSWError) C.int {
+		return C.searchKnnEf(h.index, v, C.int(N), C.int(ef), label, dist, cerr)
+	})
+}
+
+// SearchKNNFiltered is SearchKNNWithEf returning only labels set in allow. The
+// allow list is checked while the graph is traversed, so N results come back
+// whenever N allowed points are reachable.
+func (h *HNSW) SearchKNNFiltered(vector []float32, N int, ef int, allow Bitset) ([]uint32, []float32, error) {
+	if len(allow) == 0 {
+		return nil, nil, nil
+	}
+	return searchKNN(h.dim, h.normalize, vector, N, func(v *C.float, label *C.ulong, dist *C.float, cerr *C.HNSWError) C.int {
+		return C.searchKnnFiltered(h.index, v, C.int(N), C.int(ef), (*C.uint64_t)(unsafe.Pointer(&allow[0])), C.ulong(len(allow)), label, dist, cerr)
+	})
+}
+
+// SearchKNNAmong computes exact distances to the given labels only and returns
+// the N closest. It is the brute force path for very selective filters.
+func (h *HNSW) SearchKNNAmong(vector []float32, N int, candidates []uint32) ([]uint32, []float32, error) {
+	if len(candidates) == 0 {
+		return nil, nil, nil
+	}
+	Ccandidates := make([]C.ulong, len(candidates))
+	for i, label := range candidates {
+		Ccandidates[i] = C.ulong(label)
+	}
+	return searchKNN(h.dim, h.normalize, vector, N, func(v *C.float, label *C.ulong, dist *C.float, cerr *C.HNSWError) C.int {
+		return C.searchKnnAmong(h.index, v, C.int(N), &Ccandidates[0], C.ulong(len(Ccandidates)), label, dist, cerr)
+	})
+}
+
+// SearchKNNExact computes exact distances to every stored point and returns
+// the N closest.
+func (h *HNSW) SearchKNNExact(vector []float32, N int) ([]uint32, []float32, error) {
+	return searchKNN(h.dim, h.normalize, vector, N, func(v *C.float, label *C.ulong, dist *C.float, cerr *C.HNSWError) C.int {
+		return C.searchKnnExact(h.index, v, C.int(N), label, dist, cerr)
+	})
+}
+
+func searchKNN(dim int, normalize bool, vector []float32, N int, search func(v *C.float, label *C.ulong, dist *C.float, cerr *C.HNSWError) C.int) ([]uint32, []float32, error) {
+	if len(vector) != dim {
+		return nil, nil, ErrDimensionMismatch
+	}
+	if N <= 0 {
+		return nil, nil, nil
+	}
+	Clabel := make([]C.ulong, N)
+	Cdist := make([]C.float, N)
+	if normalize {
 		vector = normalizeVector(vector)
 	}
-	numResult := int(C.searchKnn(h.index, (*C.float)(unsafe.Pointer(&vector[0])), C.int(N), &Clabel[0], &Cdist[0]))
-	labels := make([]uint32, N)
-	dists := make([]float32, N)
+	var cerr C.HNSWError
+	numResult := int(search((*C.float)(unsafe.Pointer(&vector[0])), &Clabel[0], &Cdist[0], &cerr))
+	if numResult < 0 {
+		return nil, nil, newError(&cerr)
+	}
+	labels := make([]uint32, numResult)
+	dists := make([]float32, numResult)
 	for i := 0; i < numResult; i++ {
 		labels[i] = uint32(Clabel[i])
 		dists[i] = float32(Cdist[i])
 	}
-	return labels[:numResult], dists[:numResult]
+	return labels, dists, nil
 }
 
 func (h *HNSW) SetEf(ef int) {
 	C.setEf(h.index, C.int(ef))
 }
+
+// MarkDelete tombstones the point with the given label. The point stays in
+// the graph for traversal but is never returned by SearchKNN.
+func (h *HNSW) MarkDelete(label uint32) error {
+	var cerr C.HNSWError
+	if C.markDelete(h.index, C.ulong(label), &cerr) != C.HNSW_OK {
+		return newError(&cerr)
+	}
+	return nil
+}
+
+// UnmarkDelete removes the tombstone set by MarkDelete.
+func (h *HNSW) UnmarkDelete(label uint32) error {
+	var cerr C.HNSWError
+	if C.unmarkDelete(h.index, C.ulong(label), &cerr) != C.HNSW_OK {
+		return newError(&cerr)
+	}
+	return nil
+}
+
+// Resize changes the capacity of the index. It must not run concurrently with
+// any other call on the same index.
+func (h *HNSW) Resize(maxElements uint32) error {
+	var cerr C.HNSWError
+	if C.resizeIndex(h.index, C.ulong(maxElements), &cerr) != C.HNSW_OK {
+		return newError(&cerr)
+	}
+	return nil
+}
+
+func (h *HNSW) MaxElements() uint32 {
+	return uint32(C.getMaxElements(h.index))
+}
+
+// Len returns the number of points stored in the index, tombstones included.
+func (h *HNSW) Len() uint32 {
+	return uint32(C.getCurrentCount(h.index))
+}
+
+// GetDataByLabel returns the vector stored under label. Cosine indexes store
+// normalized vectors, so that is what they return.
+func (h *HNSW) GetDataByLabel(label uint32) ([]float32, error) {
+	vector := make([]float32, h.dim)
+	var cerr C.HNSWError
+	if C.getDataByLabel(h.index, C.ulong(label), (*C.float)(unsafe.Pointer(&vector[0])), &cerr) != C.HNSW_OK {
+		return nil, newError(&cerr)
+	}
+	return vector, nil
+}
@@ -0,0 +1,992 @@
+//go:build !cgo || purego
+
+package hnswgo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// HNSW is a Go port of hnswlib's HierarchicalNSW, reading and writing its
+// index format. Writes hold an exclusive lock, so inserts do not run in
+// parallel.
+type HNSW struct {
+	spaceType string
+	dim       int
+	normalize bool
+	distance  func(a, b []float32) float32
+
+	mtx            sync.RWMutex
+	m              int
+	maxM           int
+	maxM0          int
+	efConstruction int
+	ef             int
+	mult           float64
+	rng            *rand.Rand
+	maxElements    uint32
+	// vectors holds dim floats per element, in element order
+	vectors  []float32
+	nodes    []node
+	labels   map[uint32]uint32
+	entry    uint32
+	maxLevel int
+
+	visited sync.Pool
+}
+
+type node struct {
+	label   uint32
+	deleted bool
+	// links[l] lists the neighbours on level l; the node lives on levels 0
+	// to len(links)-1
+	links [][]uint32
+}
+
+var (
+	errLabelNotFound = &Error{Code: CodeUnknownLabel, Message: "Label not found"}
+	errCapacity      = &Error{Code: CodeCapacityExceeded, Message: "The number of elements exceeds the specified limit"}
+	errOpenFile      = &Error{Code: CodeIO, Message: "Cannot open file"}
+	errResize        = &Error{Code: CodeUnknown, Message: "Cannot resize, max element is less than the current number of elements"}
+)
+
+// newSpace returns the distance of a space type and whether vectors are
+// normalized on the way in, as spaceChar does for hnswlib.
+func newSpace(spaceType string) (func(a, b []float32) float32, bool) {
+	switch spaceType {
+	case "ip":
+		return innerProductDistance, false
+	case "cosine":
+		return innerProductDistance, true
+	default:
+		return l2Distance, false
+	}
+}
+
+func innerProductDistance(a, b []float32) float32 {
+	var dot float32
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	return 1 - dot
+}
+
+func l2Distance(a, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return sum
+}
+
+func New(dim, M, efConstruction, randSeed int, maxElements uint32, spaceType string) (*HNSW, error) {
+	if efConstruction < M {
+		efConstruction = M
+	}
+	h := newHNSW(dim, spaceType, randSeed)
+	h.m = M
+	h.maxM = M
+	h.maxM0 = 2 * M
+	h.efConstruction = efConstruction
+	h.mult = 1 / math.Log(float64(M))
+	h.maxElements = maxElements
+	h.maxLevel = -1
+	return h, nil
+}
+
+func newHNSW(dim int, spaceType string, randSeed int) *HNSW {
+	distance, normalize := newSpace(spaceType)
+	return &HNSW{
+		spaceType: spaceType,
+		dim:       dim,
+		normalize: normalize,
+		distance:  distance,
+		ef:        10,
+		rng:       rand.New(rand.NewSource(int64(randSeed))),
+		labels:    make(map[uint32]uint32),
+	}
+}
+
+// The level 0 record of an element is a link list of maxM0 slots, the vector
+// and a 64 bit label. A link list is a uint32 holding the neighbour count in
+// its low 16 bits, with the delete mark in bit 16 for level 0, followed by the
+// neighbour slots. Elements above level 0 follow the records as a uint32 byte
+// count and one link list of maxM slots per level.
+const deleteMark = 1 << 16
+
+// Load reads an index saved by Save or by hnswlib. hnswlib does not store its
+// random seed; a loaded index draws levels from seed 100.
+func Load(location string, dim int, spaceType string) (*HNSW, error) {
+	f, err := os.Open(location)
+	if err != nil {
+		return nil, errOpenFile
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	h, err := ReadFrom(r, dim, spaceType)
+	if err != nil {
+		return nil, err
+	}
+	// like hnswlib, reject a file running past the index
+	if _, err := r.ReadByte(); err != io.EOF {
+		return nil, errCorrupted
+	}
+	return h, nil
+}
+
+// ReadFrom reads an index in the format Save writes, as Load does from a
+// file. It reads exactly the index from r, nothing past it.
+func ReadFrom(r io.Reader, dim int, spaceType string) (*HNSW, error) {
+	var hdr indexHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, readError(err)
+	}
+	if err := hdr.check(dim); err != nil {
+		return nil, err
+	}
+
+	h := newHNSW(dim, spaceType, 100)
+	h.m = int(hdr.M)
+	h.maxM = int(hdr.MaxM)
+	h.maxM0 = int(hdr.MaxM0)
+	h.efConstruction = int(hdr.EFConstruction)
+	h.mult = hdr.Mult
+	h.maxElements = uint32(hdr.MaxElements)
+	h.maxLevel = int(hdr.MaxLevel)
+	h.entry = hdr.EntryPoint
+
+	// the count is not trusted until the records are there
+	count := uint32(hdr.Count)
+	reserve := minInt(int(count), 1<<16)
+	h.nodes = make([]node, 0, reserve)
+	h.vectors = make([]float32, 0, reserve*dim)
+
+	readLinks := func(rec []byte, max int) ([]uint32, bool) {
+		header := binary.LittleEndian.Uint32(rec)
+		n := int(header & 0xffff)
+		if n > max {
+			return nil, false
+		}
+		links := make([]uint32, n, max)
+		for i := range links {
+			links[i] = binary.LittleEndian.Uint32(rec[4+4*i:])
+			if links[i] >= count {
+				return nil, false
+			}
+		}
+		return links, true
+	}
+
+	rec := make([]byte, hdr.SizePerElement)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return nil, readError(err)
+		}
+
+		links, ok := readLinks(rec, h.maxM0)
+		if !ok {
+			return nil, errCorrupted
+		}
+		for j := 0; j < dim; j++ {
+			h.vectors = append(h.vectors, math.Float32frombits(binary.LittleEndian.Uint32(rec[hdr.OffsetData+uint64(4*j):])))
+		}
+		label := binary.LittleEndian.Uint64(rec[hdr.LabelOffset:])
+		if label > math.MaxUint32 {
+			return nil, errCorrupted
+		}
+
+		h.nodes = append(h.nodes, node{
+			label:   uint32(label),
+			deleted: binary.LittleEndian.Uint32(rec)&deleteMark != 0,
+			links:   [][]uint32{links},
+		})
+		h.labels[uint32(label)] = i
+	}
+
+	linksSize := hdr.MaxM*4 + 4
+	for i := range h.nodes {
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, readError(err)
+		}
+		if uint64(size)%linksSize != 0 || uint64(size)/linksSize > uint64(hdr.MaxLevel) {
+			return nil, errCorrupted
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, readError(err)
+		}
+		for ; len(data) > 0; data = data[linksSize:] {
+			links, ok := readLinks(data, h.maxM)
+			if !ok {
+				return nil, errCorrupted
+			}
+			h.nodes[i].links = append(h.nodes[i].links, links)
+		}
+	}
+
+	// searches index links[level] of every neighbour without checking
+	for _, n := range h.nodes {
+		for level, links := range n.links {
+			for _, neighbour := range links {
+				if len(h.nodes[neighbour].links) <= level {
+					return nil, errCorrupted
+				}
+			}
+		}
+	}
+	if count == 0 {
+		h.maxLevel = -1
+	} else if h.entry >= count || len(h.nodes[h.entry].links) != h.maxLevel+1 {
+		return nil, errCorrupted
+	}
+
+	return h, nil
+}
+
+func (h *HNSW) Save(location string) error {
+	f, err := os.Create(location)
+	if err != nil {
+		return errOpenFile
+	}
+	return writeFile(f, h)
+}
+
+// WriteTo writes the index to w in the format Save writes to a file.
+func (h *HNSW) WriteTo(w io.Writer) (int64, error) {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	linksSize0 := h.maxM0*4 + 4
+	linksSize := h.maxM*4 + 4
+	hdr := indexHeader{
+		MaxElements:    uint64(h.maxElements),
+		Count:          uint64(len(h.nodes)),
+		SizePerElement: uint64(linksSize0 + h.dim*4 + 8),
+		LabelOffset:    uint64(linksSize0 + h.dim*4),
+		OffsetData:     uint64(linksSize0),
+		MaxLevel:       int32(h.maxLevel),
+		EntryPoint:     h.entry,
+		MaxM:           uint64(h.maxM),
+		MaxM0:          uint64(h.maxM0),
+		M:              uint64(h.m),
+		Mult:           h.mult,
+		EFConstruction: uint64(h.efConstruction),
+	}
+	if h.maxLevel < 0 {
+		hdr.EntryPoint = math.MaxUint32
+	}
+
+	cw := countWriter{w: w}
+	cw.writeValue(&hdr)
+
+	appendLinks := func(buf []byte, links []uint32, slots int, mark uint32) []byte {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(links))|mark)
+		for i := 0; i < slots; i++ {
+			var neighbour uint32
+			if i < len(links) {
+				neighbour = links[i]
+			}
+			buf = binary.LittleEndian.AppendUint32(buf, neighbour)
+		}
+		return buf
+	}
+
+	// records are gathered into chunks of about streamChunk bytes
+	var buf []byte
+	for i, n := range h.nodes {
+		var mark uint32
+		if n.deleted {
+			mark = deleteMark
+		}
+		buf = appendLinks(buf, n.links[0], h.maxM0, mark)
+		for _, x := range h.vector(uint32(i)) {
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(x))
+		}
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(n.label))
+		if len(buf) >= streamChunk {
+			cw.Write(buf)
+			buf = buf[:0]
+		}
+	}
+	for _, n := range h.nodes {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32((len(n.links)-1)*linksSize))
+		for _, links := range n.links[1:] {
+			buf = appendLinks(buf, links, h.maxM, 0)
+		}
+		if len(buf) >= streamChunk {
+			cw.Write(buf)
+			buf = buf[:0]
+		}
+	}
+	cw.Write(buf)
+
+	return cw.result()
+}
+
+// writeFile writes index to f through a buffer and closes f.
+func writeFile(f *os.File, index io.WriterTo) error {
+	w := bufio.NewWriter(f)
+	if _, err := index.WriteTo(w); err != nil {
+		f.Close()
+		return err
+	}
+	err := w.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return &Error{Code: CodeIO, Message: err.Error()}
+	}
+	return nil
+}
+
+// Free drops the index data. The index must not be used afterwards.
+func (h *HNSW) Free() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.vectors, h.nodes, h.labels = nil, nil, nil
+}
+
+func (h *HNSW) vector(id uint32) []float32 {
+	return h.vectors[int(id)*h.dim : (int(id)+1)*h.dim]
+}
+
+func (h *HNSW) AddPoint(vector []float32, label uint32) error {
+	if len(vector) != h.dim {
+		return ErrDimensionMismatch
+	}
+	if h.normalize {
+		vector = normalizeVector(vector)
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return h.addPointUnsafe(vector, label)
+}
+
+// AddPoints is AddPoint for every vector. threads is ignored: inserts hold
+// the index lock.
+func (h *HNSW) AddPoints(vectors [][]float32, labels []uint32, threads int) ([]ErrorCode, error) {
+	if len(vectors) != len(labels) {
+		return nil, &Error{Code: CodeUnknown, Message: "vectors and labels differ in length"}
+	}
+	flat, err := flatten(h.dim, h.normalize, vectors)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	var (
+		codes    []ErrorCode
+		firstErr error
+	)
+	for i, label := range labels {
+		err := h.addPointUnsafe(flat[i*h.dim:(i+1)*h.dim], label)
+		if err == nil {
+			continue
+		}
+		if codes == nil {
+			codes = make([]ErrorCode, len(labels))
+			firstErr = err
+		}
+		codes[i] = err.(*Error).Code
+	}
+	return codes, firstErr
+}
+
+// addPointUnsafe follows HierarchicalNSW::addPoint. A label already stored
+// gets the new vector and fresh neighbours, and loses its delete mark.
+func (h *HNSW) addPointUnsafe(vector []float32, label uint32) error {
+	if id, found := h.labels[label]; found {
+		copy(h.vector(id), vector)
+		h.nodes[id].deleted = false
+		h.connect(id, len(h.nodes[id].links)-1, true)
+		return nil
+	}
+
+	if uint32(len(h.nodes)) >= h.maxElements {
+		return errCapacity
+	}
+
+	id := uint32(len(h.nodes))
+	level := int(-math.Log(1-h.rng.Float64()) * h.mult)
+	h.nodes = append(h.nodes, node{label: label, links: make([][]uint32, level+1)})
+	h.vectors = append(h.vectors, vector...)
+	h.labels[label] = id
+
+	if h.maxLevel < 0 {
+		h.entry, h.maxLevel = id, level
+		return nil
+	}
+
+	h.connect(id, level, false)
+	if level > h.maxLevel {
+		h.entry, h.maxLevel = id, level
+	}
+	return nil
+}
+
+// connect links element id into levels 0 to level.
+func (h *HNSW) connect(id uint32, level int, update bool) {
+	if update && len(h.nodes) == 1 {
+		return
+	}
+
+	q := h.vector(id)
+	ep := h.entry
+	epDist := h.distance(q, h.vector(ep))
+	for l := h.maxLevel; l > level; l-- {
+		ep, epDist = h.greedy(q, ep, epDist, l)
+	}
+
+	accept := func(n uint32) bool {
+		return n != id && !h.nodes[n].deleted
+	}
+	for l := minInt(level, h.maxLevel); l >= 0; l-- {
+		candidates := h.searchLayer(q, ep, h.efConstruction, l, accept)
+		if h.nodes[h.entry].deleted && h.entry != id {
+			candidates = append(candidates, candidate{id: h.entry, dist: h.distance(q, h.vector(h.entry))})
+			sortCandidates(candidates)
+			if len(candidates) > h.efConstruction {
+				candidates = candidates[:h.efConstruction]
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+
+		neighbours := h.selectNeighbours(candidates, h.m)
+		links := make([]uint32, len(neighbours), h.maxLinks(l))
+		for i, c := range neighbours {
+			links[i] = c.id
+		}
+		h.nodes[id].links[l] = links
+
+		for _, neighbour := range links {
+			h.addLink(neighbour, id, l, update)
+		}
+		ep = neighbours[0].id
+	}
+}
+
+func (h *HNSW) maxLinks(level int) int {
+	if level == 0 {
+		return h.maxM0
+	}
+	return h.maxM
+}
+
+// addLink adds id to the neighbours of n on level, pruning them with the
+// heuristic when the list is full.
+func (h *HNSW) addLink(n, id uint32, level int, update bool) {
+	links := h.nodes[n].links[level]
+	if update {
+		for _, l := range links {
+			if l == id {
+				return
+			}
+		}
+	}
+
+	max := h.maxLinks(level)
+	if len(links) < max {
+		h.nodes[n].links[level] = append(links, id)
+		return
+	}
+
+	v := h.vector(n)
+	candidates := make([]candidate, 0, len(links)+1)
+	candidates = append(candidates, candidate{id: id, dist: h.distance(h.vector(id), v)})
+	for _, l := range links {
+		candidates = append(candidates, candidate{id: l, dist: h.distance(h.vector(l), v)})
+	}
+	sortCandidates(candidates)
+
+	links = links[:0]
+	for _, c := range h.selectNeighbours(candidates, max) {
+		links = append(links, c.id)
+	}
+	h.nodes[n].links[level] = links
+}
+
+// selectNeighbours is hnswlib's getNeighborsByHeuristic2 over candidates
+// sorted closest first: a candidate is kept unless a kept one is closer to it
+// than the base element is.
+func (h *HNSW) selectNeighbours(candidates []candidate, m int) []candidate {
+	if len(candidates) < m {
+		return candidates
+	}
+
+	selected := make([]candidate, 0, m)
+	for _, c := range candidates {
+		if len(selected) >= m {
+			break
+		}
+		good := true
+		for _, s := range selected {
+			if h.distance(h.vector(s.id), h.vector(c.id)) < c.dist {
+				good = false
+				break
+			}
+		}
+		if good {
+			selected = append(selected, c)
+		}
+	}
+	return selected
+}
+
+// greedy walks level towards q as long as a neighbour is closer.
+func (h *HNSW) greedy(q []float32, ep uint32, epDist float32, level int) (uint32, float32) {
+	for changed := true; changed; {
+		changed = false
+		for _, n := range h.nodes[ep].links[level] {
+			if d := h.distance(q, h.vector(n)); d < epDist {
+				ep, epDist, changed = n, d, true
+			}
+		}
+	}
+	return ep, epDist
+}
+
+// searchLayer returns up to ef elements accepted by accept closest to q on
+// level, closest first. Rejected elements are still expanded, so the graph
+// stays connected for the traversal.
+func (h *HNSW) searchLayer(q []float32, ep uint32, ef int, level int, accept func(id uint32) bool) []candidate {
+	visited := h.getVisited()
+	defer h.visited.Put(visited)
+
+	results := candidateHeap{max: true}
+	frontier := candidateHeap{}
+
+	lowerBound := float32(math.MaxFloat32)
+	d := h.distance(q, h.vector(ep))
+	if accept(ep) {
+		results.push(candidate{id: ep, dist: d})
+		lowerBound = d
+	}
+	frontier.push(candidate{id: ep, dist: d})
+	visited.visit(ep)
+
+	for frontier.len() > 0 {
+		current := frontier.top()
+		if current.dist > lowerBound && results.len() >= ef {
+			break
+		}
+		frontier.pop()
+
+		for _, n := range h.nodes[current.id].links[level] {
+			if !visited.visit(n) {
+				continue
+			}
+
+			d := h.distance(q, h.vector(n))
+			if results.len() < ef || d < lowerBound {
+				frontier.push(candidate{id: n, dist: d})
+				if accept(n) {
+					results.push(candidate{id: n, dist: d})
+				}
+				if results.len() > ef {
+					results.pop()
+				}
+				if results.len() > 0 {
+					lowerBound = results.top().dist
+				}
+			}
+		}
+	}
+
+	return results.sorted()
+}
+
+func (h *HNSW) SearchKNN(vector []float32, N int) ([]uint32, []float32, error) {
+	return h.search(vector, N, 0, nil)
+}
+
+// SearchKNNWithEf is SearchKNN with the size of the dynamic candidate list
+// chosen for this call only. A non-positive ef means the SetEf value.
+func (h *HNSW) SearchKNNWithEf(vector []float32, N int, ef int) ([]uint32, []float32, error) {
+	return h.search(vector, N, ef, nil)
+}
+
+// SearchKNNFiltered is SearchKNNWithEf returning only labels set in allow. The
+// allow list is checked while the graph is traversed, so N results come back
+// whenever N allowed points are reachable.
+func (h *HNSW) SearchKNNFiltered(vector []float32, N int, ef int, allow Bitset) ([]uint32, []float32, error) {
+	if len(allow) == 0 {
+		return nil, nil, nil
+	}
+	return h.search(vector, N, ef, allow)
+}
+
+func (h *HNSW) search(vector []float32, N int, ef int, allow Bitset) ([]uint32, []float32, error) {
+	if len(vector) != h.dim {
+		return nil, nil, ErrDimensionMismatch
+	}
+	if N <= 0 {
+		return nil, nil, nil
+	}
+	if h.normalize {
+		vector = normalizeVector(vector)
+	}
+
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	if len(h.nodes) == 0 {
+		return nil, nil, nil
+	}
+	if ef <= 0 {
+		ef = h.ef
+	}
+	if ef < N {
+		ef = N
+	}
+
+	ep := h.entry
+	epDist := h.distance(vector, h.vector(ep))
+	for l := h.maxLevel; l > 0; l-- {
+		ep, epDist = h.greedy(vector, ep, epDist, l)
+	}
+
+	results := h.searchLayer(vector, ep, ef, 0, func(id uint32) bool {
+		n := &h.nodes[id]
+		return !n.deleted && (allow == nil || allow.Has(n.label))
+	})
+	if len(results) > N {
+		results = results[:N]
+	}
+
+	labels := make([]uint32, len(results))
+	dists := make([]float32, len(results))
+	for i, c := range results {
+		labels[i] = h.nodes[c.id].label
+		dists[i] = c.dist
+	}
+	return labels, dists, nil
+}
+
+// SearchKNNAmong computes exact distances to the given labels only and returns
+// the N closest. It is the brute force path for very selective filters.
+func (h *HNSW) SearchKNNAmong(vector []float32, N int, candidates []uint32) ([]uint32, []float32, error) {
+	if len(vector) != h.dim {
+		return nil, nil, ErrDimensionMismatch
+	}
+	if N <= 0 || len(candidates) == 0 {
+		return nil, nil, nil
+	}
+	if h.normalize {
+		vector = normalizeVector(vector)
+	}
+
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	top := candidateHeap{max: true}
+	for _, label := range candidates {
+		id, found := h.labels[label]
+		if !found || h.nodes[id].deleted {
+			continue
+		}
+		top.pushBounded(candidate{id: label, dist: h.distance(vector, h.vector(id))}, N)
+	}
+	labels, dists := top.split()
+	return labels, dists, nil
+}
+
+// SearchKNNExact computes exact distances to every stored point and returns
+// the N closest.
+func (h *HNSW) SearchKNNExact(vector []float32, N int) ([]uint32, []float32, error) {
+	if len(vector) != h.dim {
+		return nil, nil, ErrDimensionMismatch
+	}
+	if N <= 0 {
+		return nil, nil, nil
+	}
+	if h.normalize {
+		vector = normalizeVector(vector)
+	}
+
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	top := candidateHeap{max: true}
+	for label, id := range h.labels {
+		if h.nodes[id].deleted {
+			continue
+		}
+		top.pushBounded(candidate{id: label, dist: h.distance(vector, h.vector(id))}, N)
+	}
+	labels, dists := top.split()
+	return labels, dists, nil
+}
+
+// SearchKNNBatch runs SearchKNN for every vector on threads goroutines, one
+// per core when threads is not positive.
+func (h *HNSW) SearchKNNBatch(vectors [][]float32, N int, threads int) ([][]uint32, [][]float32, error) {
+	return searchBatch(len(vectors), threads, func(i int) ([]uint32, []float32, error) {
+		return h.SearchKNN(vectors[i], N)
+	})
+}
+
+// searchBatch runs search(i) for i in [0, n) on threads goroutines.
+func searchBatch(n int, threads int, search func(i int) ([]uint32, []float32, error)) ([][]uint32, [][]float32, error) {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	if threads > n {
+		threads = n
+	}
+
+	labels := make([][]uint32, n)
+	dists := make([][]float32, n)
+	errs := make([]error, n)
+
+	var (
+		wg   sync.WaitGroup
+		next = make(chan int)
+	)
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				labels[i], dists[i], errs[i] = search(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return labels, dists, nil
+}
+
+func (h *HNSW) SetEf(ef int) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.ef = ef
+}
+
+// MarkDelete tombstones the point with the given label. The point stays in
+// the graph for traversal but is never returned by SearchKNN.
+func (h *HNSW) MarkDelete(label uint32) error {
+	return h.setDeleted(label, true)
+}
+
+// UnmarkDelete removes the tombstone set by MarkDelete.
+func (h *HNSW) UnmarkDelete(label uint32) error {
+	return h.setDeleted(label, false)
+}
+
+func (h *HNSW) setDeleted(label uint32, deleted bool) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	id, found := h.labels[label]
+	if !found {
+		return errLabelNotFound
+	}
+	h.nodes[id].deleted = deleted
+	return nil
+}
+
+// Resize changes the capacity of the index.
+func (h *HNSW) Resize(maxElements uint32) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if maxElements < uint32(len(h.nodes)) {
+		return errResize
+	}
+	h.maxElements = maxElements
+	return nil
+}
+
+func (h *HNSW) MaxElements() uint32 {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	return h.maxElements
+}
+
+// Len returns the number of points stored in the index, tombstones included.
+func (h *HNSW) Len() uint32 {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	return uint32(len(h.nodes))
+}
+
+// GetDataByLabel returns the vector stored under label. Cosine indexes store
+// normalized vectors, so that is what they return.
+func (h *HNSW) GetDataByLabel(label uint32) ([]float32, error) {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	id, found := h.labels[label]
+	if !found || h.nodes[id].deleted {
+		return nil, errLabelNotFound
+	}
+	return append([]float32(nil), h.vector(id)...), nil
+}
+
+// visitedList marks elements seen by one search. Bumping tag clears it.
+type visitedList struct {
+	marks []uint32
+	tag   uint32
+}
+
+func (h *HNSW) getVisited() *visitedList {
+	v, _ := h.visited.Get().(*visitedList)
+	if v == nil {
+		v = &visitedList{}
+	}
+	if len(v.marks) < len(h.nodes) {
+		v.marks = make([]uint32, cap(h.nodes))
+		v.tag = 0
+	}
+	v.tag++
+	if v.tag == 0 {
+		for i := range v.marks {
+			v.marks[i] = 0
+		}
+		v.tag = 1
+	}
+	return v
+}
+
+// visit marks id and reports whether it was unmarked.
+func (v *visitedList) visit(id uint32) bool {
+	if v.marks[id] == v.tag {
+		return false
+	}
+	v.marks[id] = v.tag
+	return true
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type candidate struct {
+	id   uint32
+	dist float32
+}
+
+func sortCandidates(candidates []candidate) {
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].dist < candidates[j].dist
+	})
+}
+
+// candidateHeap is a binary heap of candidates with the farthest on top when
+// max is set, the closest otherwise.
+type candidateHeap struct {
+	items []candidate
+	max   bool
+}
+
+func (h *candidateHeap) len() int {
+	return len(h.items)
+}
+
+func (h *candidateHeap) top() candidate {
+	return h.items[0]
+}
+
+func (h *candidateHeap) less(i, j int) bool {
+	if h.max {
+		return h.items[i].dist > h.items[j].dist
+	}
+	return h.items[i].dist < h.items[j].dist
+}
+
+func (h *candidateHeap) push(c candidate) {
+	h.items = append(h.items, c)
+	for i := len(h.items) - 1; i > 0; {
+		parent := (i - 1) / 2
+		if !h.less(i, parent) {
+			break
+		}
+		h.items[i], h.items[parent] = h.items[parent], h.items[i]
+		i = parent
+	}
+}
+
+func (h *candidateHeap) pop() candidate {
+	top := h.items[0]
+	last := len(h.items) - 1
+	h.items[0] = h.items[last]
+	h.items = h.items[:last]
+	for i := 0; ; {
+		first := i
+		if l := 2*i + 1; l < last && h.less(l, first) {
+			first = l
+		}
+		if r := 2*i + 2; r < last && h.less(r, first) {
+			first = r
+		}
+		if first == i {
+			break
+		}
+		h.items[i], h.items[first] = h.items[first], h.items[i]
+		i = first
+	}
+	return top
+}
+
+// pushBounded keeps the k closest candidates pushed into a max heap.
+func (h *candidateHeap) pushBounded(c candidate, k int) {
+	if h.len() < k {
+		h.push(c)
+	} else if c.dist < h.top().dist {
+		h.pop()
+		h.push(c)
+	}
+}
+
+// sorted drains a max heap, returning its candidates closest first.
+func (h *candidateHeap) sorted() []candidate {
+	out := make([]candidate, h.len())
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = h.pop()
+	}
+	return out
+}
+
+// split drains a max heap into ids and distances, closest first.
+func (h *candidateHeap) split() ([]uint32, []float32) {
+	sorted := h.sorted()
+	ids := make([]uint32, len(sorted))
+	dists := make([]float32, len(sorted))
+	for i, c := range sorted {
+		ids[i], dists[i] = c.id, c.dist
+	}
+	return ids, dists
+}
@@ -0,0 +1,212 @@
+package hnswgo
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testDim = 8
+
+// testVectors are the vectors of the indexes in testdata: label i holds
+// vector i, label 7 is deleted. hnswlib.* were saved by the cgo build,
+// purego.* by the Go one, from New(8, 8, 50, 100, 300, "l2") and
+// NewBruteforce(8, 300, "l2").
+func testVectors() [][]float32 {
+	r := rand.New(rand.NewSource(1))
+	vectors := make([][]float32, 300)
+	for i := range vectors {
+		vectors[i] = make([]float32, testDim)
+		for j := range vectors[i] {
+			vectors[i][j] = r.Float32()
+		}
+	}
+	return vectors
+}
+
+// exactKNN returns the labels of the k vectors closest to query by l2
+// distance, leaving out label 7.
+func exactKNN(vectors [][]float32, query []float32, k int) []uint32 {
+	var labels []uint32
+	for i := range vectors {
+		if i != 7 {
+			labels = append(labels, uint32(i))
+		}
+	}
+	distance := func(label uint32) float32 {
+		var d float32
+		for j, x := range vectors[label] {
+			d += (x - query[j]) * (x - query[j])
+		}
+		return d
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return distance(labels[i]) < distance(labels[j])
+	})
+	return labels[:k]
+}
+
+func TestLoadSavedIndexes(t *testing.T) {
+	vectors := testVectors()
+
+	for _, name := range []string{"hnswlib", "purego"} {
+		t.Run(name, func(t *testing.T) {
+			h, err := Load(filepath.Join("testdata", name+".hnsw"), testDim, "l2")
+			require.NoError(t, err)
+			defer h.Free()
+			h.SetEf(50)
+
+			check := func(h *HNSW) {
+				require.Equal(t, uint32(300), h.Len())
+				require.Equal(t, uint32(300), h.MaxElements())
+
+				_, err := h.GetDataByLabel(7)
+				require.ErrorIs(t, err, ErrUnknownLabel)
+				vector, err := h.GetDataByLabel(42)
+				require.NoError(t, err)
+				require.Equal(t, vectors[42], vector)
+
+				hits := 0
+				for i, vector := range vectors {
+					labels, dists, err := h.SearchKNN(vector, 1)
+					require.NoError(t, err)
+					require.NotEqual(t, uint32(7), labels[0])
+					if labels[0] == uint32(i) {
+						require.Zero(t, dists[0])
+						hits++
+					}
+				}
+				require.GreaterOrEqual(t, hits, 295)
+
+				labels, _, err := h.SearchKNNExact(vectors[7], 10)
+				require.NoError(t, err)
+				require.Equal(t, exactKNN(vectors, vectors[7], 10), labels)
+			}
+			check(h)
+
+			path := filepath.Join(t.TempDir(), "index.hnsw")
+			require.NoError(t, h.Save(path))
+			loaded, err := Load(path, testDim, "l2")
+			require.NoError(t, err)
+			defer loaded.Free()
+			loaded.SetEf(50)
+			check(loaded)
+
+			_, err = Load(path, testDim+1, "l2")
+			require.ErrorIs(t, err, ErrIO)
+
+			// WriteTo writes what Save does, ReadFrom stops at the end of it
+			saved, err := os.ReadFile(path)
+			require.NoError(t, err)
+			var buf bytes.Buffer
+			n, err := h.WriteTo(&buf)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(saved)), n)
+			require.Equal(t, saved, buf.Bytes())
+
+			buf.WriteString("trailer")
+			streamed, err := ReadFrom(&buf, testDim, "l2")
+			require.NoError(t, err)
+			defer streamed.Free()
+			streamed.SetEf(50)
+			check(streamed)
+			require.Equal(t, "trailer", buf.String())
+			require.NoError(t, streamed.Resize(301))
+			require.NoError(t, streamed.AddPoint(vectors[7], 300))
+			labels, _, err := streamed.SearchKNN(vectors[7], 1)
+			require.NoError(t, err)
+			require.Equal(t, []uint32{300}, labels)
+
+			_, err = ReadFrom(bytes.NewReader(saved[:len(saved)-1]), testDim, "l2")
+			require.ErrorIs(t, err, ErrIO)
+
+			b, err := LoadBruteforce(filepath.Join("testdata", name+".bruteforce"), testDim, "l2")
+			require.NoError(t, err)
+			defer b.Free()
+			require.Equal(t, uint32(299), b.Len())
+			labels, _, err = b.SearchKNN(vectors[0], 10)
+			require.NoError(t, err)
+			require.Equal(t, exactKNN(vectors, vectors[0], 10), labels)
+
+			buf.Reset()
+			_, err = b.WriteTo(&buf)
+			require.NoError(t, err)
+			streamedBF, err := ReadBruteforce(&buf, testDim, "l2")
+			require.NoError(t, err)
+			defer streamedBF.Free()
+			require.Zero(t, buf.Len())
+			labels, _, err = streamedBF.SearchKNN(vectors[0], 10)
+			require.NoError(t, err)
+			require.Equal(t, exactKNN(vectors, vectors[0], 10), labels)
+		})
+	}
+}
+
+func TestHNSW(t *testing.T) {
+	h, err := New(testDim, 8, 50, 100, 2, "cosine")
+	require.NoError(t, err)
+	defer h.Free()
+
+	require.NoError(t, h.AddPoint([]float32{1, 0, 0, 0, 0, 0, 0, 0}, 10))
+	require.NoError(t, h.AddPoint([]float32{0, 2, 0, 0, 0, 0, 0, 0}, 20))
+	require.ErrorIs(t, h.AddPoint([]float32{0, 0, 1, 0, 0, 0, 0, 0}, 30), ErrCapacityExceeded)
+	require.ErrorIs(t, h.AddPoint([]float32{1}, 30), ErrDimensionMismatch)
+
+	require.NoError(t, h.Resize(3))
+	require.NoError(t, h.AddPoint([]float32{0, 0, 1, 0, 0, 0, 0, 0}, 30))
+
+	// cosine vectors are stored normalized
+	vector, err := h.GetDataByLabel(20)
+	require.NoError(t, err)
+	require.InDeltaSlice(t, []float32{0, 1, 0, 0, 0, 0, 0, 0}, vector, 1e-6)
+
+	labels, dists, err := h.SearchKNN([]float32{0, 1, 0.1, 0, 0, 0, 0, 0}, 2)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{20, 30}, labels)
+	require.Less(t, dists[0], dists[1])
+
+	labels, _, err = h.SearchKNNFiltered([]float32{0, 1, 0.1, 0, 0, 0, 0, 0}, 2, 0, bitsetOf([]uint32{10, 30}))
+	require.NoError(t, err)
+	require.Equal(t, []uint32{30, 10}, labels)
+
+	require.NoError(t, h.MarkDelete(20))
+	labels, _, err = h.SearchKNN([]float32{0, 1, 0, 0, 0, 0, 0, 0}, 3)
+	require.NoError(t, err)
+	require.NotContains(t, labels, uint32(20))
+	require.ErrorIs(t, h.MarkDelete(99), ErrUnknownLabel)
+
+	// adding a stored label replaces its vector and undeletes it
+	require.NoError(t, h.AddPoint([]float32{1, 1, 0, 0, 0, 0, 0, 0}, 20))
+	require.Equal(t, uint32(3), h.Len())
+	labels, _, err = h.SearchKNN([]float32{1, 1, 0, 0, 0, 0, 0, 0}, 1)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{20}, labels)
+}
+
+func TestBruteforceUnusedRecords(t *testing.T) {
+	b, err := NewBruteforce(testDim, 2, "l2")
+	require.NoError(t, err)
+	defer b.Free()
+
+	vectors := testVectors()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, b.AddPoint(vectors[i], uint32(i)))
+	}
+	require.NoError(t, b.Resize(4))
+	require.NoError(t, b.AddPoint(vectors[2], 2))
+	require.NoError(t, b.MarkDelete(1))
+
+	// the deleted vector and the records never used are written as zeros
+	var buf bytes.Buffer
+	_, err = b.WriteTo(&buf)
+	require.NoError(t, err)
+	record := testDim*4 + 8
+	data := buf.Bytes()[24:]
+	require.Len(t, data, 4*record)
+	require.Equal(t, make([]byte, 2*record), data[2*record:])
+}
@@ -1,34 +1,223 @@
+//go:build cgo && !purego
+
 //hnsw_wrapper.cpp
 #include <iostream>
 #include "hnswlib/hnswlib.h"
 #include "hnsw_wrapper.h"
 #include <thread>
 #include <atomic>
+#include <new>
 
-HNSW initHNSW(int dim, unsigned long int max_elements, int M, int ef_construction, int rand_seed, char stype) {
-  hnswlib::SpaceInterface<float> *space;
-  if (stype == 'i') {
-    space = new hnswlib::InnerProductSpace(dim);
+// Every entry point catches all exceptions: a C++ exception unwinding into Go
+// aborts the whole process.
+
+static int setError(HNSWError *err, int code, const char *message) {
+  if (err != NULL) {
+    err->code = code;
+    strncpy(err->message, message, HNSW_ERR_MSG_SIZE - 1);
+    err->message[HNSW_ERR_MSG_SIZE - 1] = '\0';
+  }
+  return code;
+}
+
+static int classifyError(const char *message) {
+  if (strstr(message, "exceeds the specified limit") != NULL) {
+    return HNSW_ERR_CAPACITY;
+  }
+  if (strstr(message, "Label not found") != NULL) {
+    return HNSW_ERR_UNKNOWN_LABEL;
+  }
+  if (strstr(message, "Cannot open file") != NULL || strstr(message, "corrupted") != NULL) {
+    return HNSW_ERR_IO;
+  }
+  if (strstr(message, "Not enough memory") != NULL) {
+    return HNSW_ERR_MEMORY;
+  }
+  return HNSW_ERR_UNKNOWN;
+}
+
+// handleException must be called from a catch block.
+static int handleException(HNSWError *err) {
+  try {
+    throw;
+  } catch (const std::bad_alloc& e) {
+    return setError(err, HNSW_ERR_MEMORY, e.what());
+  } catch (const std::exception& e) {
+    return setError(err, classifyError(e.what()), e.what());
+  } catch (...) {
+    return setError(err, HNSW_ERR_UNKNOWN, "unknown exception");
+  }
+}
+
+typedef hnswlib::HierarchicalNSW<float> HierarchicalNSW;
+typedef std::priority_queue<std::pair<float, hnswlib::tableint>, std::vector<std::pair<float, hnswlib::tableint>>, HierarchicalNSW::CompareByFirst> candidateQueue;
+
+static bool isAllowed(const uint64_t *allow, size_t allow_words, hnswlib::labeltype label) {
+  if (allow == NULL) {
+    return true;
+  }
+  size_t word = label / 64;
+  return word < allow_words && ((allow[word] >> (label % 64)) & 1);
+}
+
+// searchBaseLayerFiltered is HierarchicalNSW::searchBaseLayerST that only
+// collects allowed, undeleted elements. Rejected elements are still expanded,
+// so the graph stays connected for the traversal.
+static candidateQueue searchBaseLayerFiltered(const HierarchicalNSW *alg, hnswlib::tableint ep_id, const void *data_point, size_t ef, const uint64_t *allow, size_t allow_words) {
+  hnswlib::VisitedList *vl = alg->visited_list_pool_->getFreeVisitedList();
+  hnswlib::vl_type *visited_array = vl->mass;
+  hnswlib::vl_type visited_array_tag = vl->curV;
+
+  candidateQueue top_candidates;
+  candidateQueue candidate_set;
+
+  float lowerBound;
+  if (!alg->isMarkedDeleted(ep_id) && isAllowed(allow, allow_words, alg->getExternalLabel(ep_id))) {
+    float dist = alg->fstdistfunc_(data_point, alg->getDataByInternalId(ep_id), alg->dist_func_param_);
+    lowerBound = dist;
+    top_candidates.emplace(dist, ep_id);
+    candidate_set.emplace(-dist, ep_id);
   } else {
-    space = new hnswlib::L2Space(dim);
+    lowerBound = std::numeric_limits<float>::max();
+    candidate_set.emplace(-lowerBound, ep_id);
+  }
+  visited_array[ep_id] = visited_array_tag;
+
+  while (!candidate_set.empty()) {
+    std::pair<float, hnswlib::tableint> current_node_pair = candidate_set.top();
+    if ((-current_node_pair.first) > lowerBound && top_candidates.size() >= ef) {
+      break;
+    }
+    candidate_set.pop();
+
+    int *data = (int *) alg->get_linklist0(current_node_pair.second);
+    size_t size = alg->getListCount((hnswlib::linklistsizeint*)data);
+    for (size_t j = 1; j <= size; j++) {
+      int candidate_id = *(data + j);
+      if (visited_array[candidate_id] == visited_array_tag) {
+        continue;
+      }
+      visited_array[candidate_id] = visited_array_tag;
+
+      float dist = alg->fstdistfunc_(data_point, alg->getDataByInternalId(candidate_id), alg->dist_func_param_);
+      if (top_candidates.size() < ef || lowerBound > dist) {
+        candidate_set.emplace(-dist, candidate_id);
+        if (!alg->isMarkedDeleted(candidate_id) && isAllowed(allow, allow_words, alg->getExternalLabel(candidate_id))) {
+          top_candidates.emplace(dist, candidate_id);
+        }
+        if (top_candidates.size() > ef) {
+          top_candidates.pop();
+        }
+        if (!top_candidates.empty()) {
+          lowerBound = top_candidates.top().first;
+        }
+      }
+    }
   }
-  hnswlib::HierarchicalNSW<float> *appr_alg = new hnswlib::HierarchicalNSW<float>(space, max_elements, M, ef_construction, rand_seed);
-  return (void*)appr_alg;
+
+  alg->visited_list_pool_->releaseVisitedList(vl);
+  return top_candidates;
 }
 
-HNSW loadHNSW(char *location, int dim, char stype) {
-  hnswlib::SpaceInterface<float> *space;
+// searchKnnWith mirrors HierarchicalNSW::searchKnn with an optional allow
+// list. Results are written closest first; the count is returned.
+static int searchKnnWith(const HierarchicalNSW *alg, const void *query_data, size_t k, size_t ef, const uint64_t *allow, size_t allow_words, unsigned long int *label, float *dist) {
+  if (alg->cur_element_count == 0) {
+    return 0;
+  }
+
+  hnswlib::tableint currObj = alg->enterpoint_node_;
+  float curdist = alg->fstdistfunc_(query_data, alg->getDataByInternalId(currObj), alg->dist_func_param_);
+
+  for (int level = alg->maxlevel_; level > 0; level--) {
+    bool changed = true;
+    while (changed) {
+      changed = false;
+      unsigned int *data = (unsigned int *) alg->get_linklist(currObj, level);
+      int size = alg->getListCount(data);
+      hnswlib::tableint *datal = (hnswlib::tableint *) (data + 1);
+      for (int i = 0; i < size; i++) {
+        hnswlib::tableint cand = datal[i];
+        if (cand > alg->max_elements_) {
+          throw std::runtime_error("cand error");
+        }
+        float d = alg->fstdistfunc_(query_data, alg->getDataByInternalId(cand), alg->dist_func_param_);
+        if (d < curdist) {
+          curdist = d;
+          currObj = cand;
+          changed = true;
+        }
+      }
+    }
+  }
+
+  candidateQueue top_candidates = searchBaseLayerFiltered(alg, currObj, query_data, std::max(ef, k), allow, allow_words);
+  while (top_candidates.size() > k) {
+    top_candidates.pop();
+  }
+
+  int n = top_candidates.size();
+  for (int i = n - 1; i >= 0; i--) {
+    *(dist+i) = top_candidates.top().first;
+    *(label+i) = alg->getExternalLabel(top_candidates.top().second);
+    top_candidates.pop();
+  }
+  return n;
+}
+
+static hnswlib::SpaceInterface<float> *newSpace(int dim, char stype) {
   if (stype == 'i') {
-    space = new hnswlib::InnerProductSpace(dim);
-  } else {
-    space = new hnswlib::L2Space(dim);
+    return new hnswlib::InnerProductSpace(dim);
+  }
+  return new hnswlib::L2Space(dim);
+}
+
+HNSW initHNSW(int dim, unsigned long int max_elements, int M, int ef_construction, int rand_seed, char stype, HNSWError *err) {
+  hnswlib::SpaceInterface<float> *space = NULL;
+  try {
+    space = newSpace(dim, stype);
+    hnswlib::HierarchicalNSW<float> *appr_alg = new hnswlib::HierarchicalNSW<float>(space, max_elements, M, ef_construction, rand_seed);
+    return (void*)appr_alg;
+  } catch (...) {
+    delete space;
+    handleException(err);
+    return NULL;
   }
-  hnswlib::HierarchicalNSW<float> *appr_alg = new hnswlib::HierarchicalNSW<float>(space, std::string(location), false, 0);
-  return (void*)appr_alg;
 }
 
-HNSW saveHNSW(HNSW index, char *location) {
-  ((hnswlib::HierarchicalNSW<float>*)index)->saveIndex(location);
+HNSW loadHNSW(char *location, int dim, char stype, HNSWError *err) {
+  hnswlib::SpaceInterface<float> *space = NULL;
+  try {
+    space = newSpace(dim, stype);
+    hnswlib::HierarchicalNSW<float> *appr_alg = new hnswlib::HierarchicalNSW<float>(space, std::string(location), false, 0);
+    if (appr_alg->label_offset_ - appr_alg->offsetData_ != space->get_data_size()) {
+      delete appr_alg;
+      delete space;
+      setError(err, HNSW_ERR_IO, "index dimension does not match");
+      return NULL;
+    }
+    return (void*)appr_alg;
+  } catch (...) {
+    delete space;
+    handleException(err);
+    return NULL;
+  }
+}
+
+int saveHNSW(HNSW index, char *location, HNSWError *err) {
+  try {
+    {
+      // saveIndex does not report a file it cannot open.
+      std::ofstream probe(location, std::ios::binary | std::ios::app);
+      if (!probe.is_open()) {
+        return setError(err, HNSW_ERR_IO, "Cannot open file");
+      }
+    }
+    ((hnswlib::HierarchicalNSW<float>*)index)->saveIndex(location);
+  } catch (...) {
+    return handleException(err);
+  }
+  return HNSW_OK;
 }
 
 void freeHNSW(HNSW index) {
@@ -36,16 +225,22 @@ void freeHNSW(HNSW index) {
   delete ptr;
 }
 
-void addPoint(HNSW index, float *vec, unsigned long int label) {
-        ((hnswlib::HierarchicalNSW<float>*)index)->addPoint(vec, label);
+int addPoint(HNSW index, float *vec, unsigned long int label, HNSWError *err) {
+  try {
+    ((hnswlib::HierarchicalNSW<float>*)index)->addPoint(vec, label);
+  } catch (...) {
+    return handleException(err);
+  }
+  return HNSW_OK;
 }
 
-int searchKnn(HNSW index, float *vec, int N, unsigned long int *label, float *dist) {
+int searchKnn(HNSW index, float *vec, int N, unsigned long int *label, float *dist, HNSWError *err) {
   std::priority_queue<std::pair<float, hnswlib::labeltype>> gt;
   try {
     gt = ((hnswlib::HierarchicalNSW<float>*)index)->searchKnn(vec, N);
-  } catch (const std::exception& e) { 
-    return 0;
+  } catch (...) {
+    handleException(err);
+    return -1;
   }
 
   int n = gt.size();
@@ -62,3 +257,621 @@ int searchKnn(HNSW index, float *vec, int N, unsigned long int *label, float *di
 void setEf(HNSW index, int ef) {
     ((hnswlib::HierarchicalNSW<float>*)index)->ef_ = ef;
 }
+
+int markDelete(HNSW index, unsigned long int label, HNSWError *err) {
+  hnswlib::HierarchicalNSW<float>* ptr = (hnswlib::HierarchicalNSW<float>*) index;
+  try {
+    // addPoint may be inserting into label_lookup_ concurrently
+    std::unique_lock<std::mutex> lock(ptr->cur_element_count_guard_);
+    ptr->markDelete(label);
+  } catch (...) {
+    return handleException(err);
+  }
+  return HNSW_OK;
+}
+
+int unmarkDelete(HNSW index, unsigned long int label, HNSWError *err) {
+  hnswlib::HierarchicalNSW<float>* ptr = (hnswlib::HierarchicalNSW<float>*) index;
+  std::unique_lock<std::mutex> lock(ptr->cur_element_count_guard_);
+  auto search = ptr->label_lookup_.find(label);
+  if (search == ptr->label_lookup_.end()) {
+    return setError(err, HNSW_ERR_UNKNOWN_LABEL, "Label not found");
+  }
+  ptr->unmarkDeletedInternal(search->second);
+  return HNSW_OK;
+}
+
+int resizeIndex(HNSW index, unsigned long int new_max_elements, HNSWError *err) {
+  try {
+    ((hnswlib::HierarchicalNSW<float>*)index)->resizeIndex(new_max_elements);
+  } catch (...) {
+    return handleException(err);
+  }
+  return HNSW_OK;
+}
+
+unsigned long int getMaxElements(HNSW index) {
+  return ((hnswlib::HierarchicalNSW<float>*)index)->max_elements_;
+}
+
+unsigned long int getCurrentCount(HNSW index) {
+  return ((hnswlib::HierarchicalNSW<float>*)index)->cur_element_count;
+}
+
+int getDataByLabel(HNSW index, unsigned long int label, float *vec, HNSWError *err) {
+  hnswlib::HierarchicalNSW<float>* ptr = (hnswlib::HierarchicalNSW<float>*) index;
+  try {
+    // label_lookup_ is only consistent under the guard addPoint holds
+    std::unique_lock<std::mutex> lock(ptr->cur_element_count_guard_);
+    std::vector<float> data = ptr->getDataByLabel<float>(label);
+    memcpy(vec, data.data(), data.size() * sizeof(float));
+  } catch (...) {
+    return handleException(err);
+  }
+  return HNSW_OK;
+}
+
+// searchKnnEf is searchKnn with ef chosen per call; ef_ is left alone, so
+// concurrent searches keep their own. A non-positive ef means ef_.
+int searchKnnEf(HNSW index, float *vec, int N, int ef, unsigned long int *label, float *dist, HNSWError *err) {
+  return searchKnnFiltered(index, vec, N, ef, NULL, 0, label, dist, err);
+}
+
+int searchKnnFiltered(HNSW index, float *vec, int N, int ef, uint64_t *allow, unsigned long int allow_words, unsigned long int *label, float *dist, HNSWError *err) {
+  HierarchicalNSW* ptr = (HierarchicalNSW*) index;
+  try {
+    return searchKnnWith(ptr, vec, N, ef > 0 ? (size_t)ef : ptr->ef_, allow, allow_words, label, dist);
+  } catch (...) {
+    handleException(err);
+    return -1;
+  }
+}
+
+int searchKnnAmong(HNSW index, float *vec, int N, unsigned long int *candidates, unsigned long int n_candidates, unsigned long int *label, float *dist, HNSWError *err) {
+  HierarchicalNSW* ptr = (HierarchicalNSW*) index;
+  std::priority_queue<std::pair<float, hnswlib::labeltype>> top;
+  try {
+    for (unsigned long int i = 0; i < n_candidates; i++) {
+      hnswlib::tableint internal_id;
+      {
+        std::unique_lock<std::mutex> lock(ptr->cur_element_count_guard_);
+        auto search = ptr->label_lookup_.find(candidates[i]);
+        if (search == ptr->label_lookup_.end()) {
+          continue;
+        }
+        internal_id = search->second;
+      }
+      if (ptr->isMarkedDeleted(internal_id)) {
+        continue;
+      }
+      float d = ptr->fstdistfunc_(vec, ptr->getDataByInternalId(internal_id), ptr->dist_func_param_);
+      if (top.size() < (size_t)N || d < top.top().first) {
+        top.emplace(d, candidates[i]);
+        if (top.size() > (size_t)N) {
+          top.pop();
+        }
+      }
+    }
+  } catch (...) {
+    handleException(err);
+    return -1;
+  }
+
+  int n = top.size();
+  for (int i = n - 1; i >= 0; i--) {
+    *(dist+i) = top.top().first;
+    *(label+i) = top.top().second;
+    top.pop();
+  }
+  return n;
+}
+
+// searchKnnExact is searchKnnAmong over every stored point, taking the label
+// lock once to copy the label map instead of once per point.
+int searchKnnExact(HNSW index, float *vec, int N, unsigned long int *label, float *dist, HNSWError *err) {
+  HierarchicalNSW* ptr = (HierarchicalNSW*) index;
+  std::priority_queue<std::pair<float, hnswlib::labeltype>> top;
+  try {
+    std::vector<std::pair<hnswlib::labeltype, hnswlib::tableint>> ids;
+    {
+      std::unique_lock<std::mutex> lock(ptr->cur_element_count_guard_);
+      ids.assign(ptr->label_lookup_.begin(), ptr->label_lookup_.end());
+    }
+    for (auto &id : ids) {
+      if (ptr->isMarkedDeleted(id.second)) {
+        continue;
+      }
+      float d = ptr->fstdistfunc_(vec, ptr->getDataByInternalId(id.second), ptr->dist_func_param_);
+      if (top.size() < (size_t)N || d < top.top().first) {
+        top.emplace(d, id.first);
+        if (top.size() > (size_t)N) {
+          top.pop();
+        }
+      }
+    }
+  } catch (...) {
+    handleException(err);
+    return -1;
+  }
+
+  int n = top.size();
+  for (int i = n - 1; i >= 0; i--) {
+    *(dist+i) = top.top().first;
+    *(label+i) = top.top().second;
+    top.pop();
+  }
+  return n;
+}
+
+// parallelFor runs fn(i) for every i in [0, n) on num_threads threads, or one
+// per core when num_threads is not positive. fn must not throw.
+template <class Function>
+static void parallelFor(size_t n, int num_threads, Function fn) {
+  if (num_threads <= 0) {
+    num_threads = std::thread::hardware_concurrency();
+  }
+  if (num_threads <= 1 || n <= 1) {
+    for (size_t i = 0; i < n; i++) {
+      fn(i);
+    }
+    return;
+  }
+  if ((size_t)num_threads > n) {
+    num_threads = n;
+  }
+
+  std::atomic<size_t> next(0);
+  std::vector<std::thread> threads;
+  for (int t = 0; t < num_threads; t++) {
+    threads.emplace_back([&]() {
+      for (size_t i = next++; i < n; i = next++) {
+        fn(i);
+      }
+    });
+  }
+  for (auto &thread : threads) {
+    thread.join();
+  }
+}
+
+int addPoints(HNSW index, float *vecs, unsigned long int *labels, unsigned long int n, int num_threads, int *codes, HNSWError *err) {
+  HierarchicalNSW* ptr = (HierarchicalNSW*) index;
+  size_t dim = *(size_t *)ptr->dist_func_param_;
+  std::atomic<bool> failed(false);
+  std::mutex err_mutex;
+
+  try {
+    parallelFor(n, num_threads, [&](size_t i) {
+      try {
+        ptr->addPoint(vecs + i * dim, labels[i]);
+        codes[i] = HNSW_OK;
+      } catch (...) {
+        HNSWError item_err;
+        codes[i] = handleException(&item_err);
+        std::unique_lock<std::mutex> lock(err_mutex);
+        if (!failed.exchange(true)) {
+          *err = item_err;
+        }
+      }
+    });
+  } catch (...) {
+    // std::thread could not be started
+    return handleException(err);
+  }
+
+  return failed ? err->code : HNSW_OK;
+}
+
+int searchKnnBatch(HNSW index, float *vecs, unsigned long int n, int N, int num_threads, unsigned long int *labels, float *dists, int *counts, HNSWError *err) {
+  HierarchicalNSW* ptr = (HierarchicalNSW*) index;
+  size_t dim = *(size_t *)ptr->dist_func_param_;
+  std::atomic<bool> failed(false);
+  std::mutex err_mutex;
+
+  try {
+    parallelFor(n, num_threads, [&](size_t i) {
+      try {
+        std::priority_queue<std::pair<float, hnswlib::labeltype>> top = ptr->searchKnn(vecs + i * dim, N);
+        int count = top.size();
+        for (int j = count - 1; j >= 0; j--) {
+          dists[i * N + j] = top.top().first;
+          labels[i * N + j] = top.top().second;
+          top.pop();
+        }
+        counts[i] = count;
+      } catch (...) {
+        HNSWError item_err;
+        handleException(&item_err);
+        counts[i] = 0;
+        std::unique_lock<std::mutex> lock(err_mutex);
+        if (!failed.exchange(true)) {
+          *err = item_err;
+        }
+      }
+    });
+  } catch (...) {
+    return handleException(err);
+  }
+
+  return failed ? err->code : HNSW_OK;
+}
+
+void getHNSWHeader(HNSW index, HNSWHeader *hdr) {
+  HierarchicalNSW *alg = (HierarchicalNSW*)index;
+  hdr->offset_level0 = alg->offsetLevel0_;
+  hdr->max_elements = alg->max_elements_;
+  hdr->count = alg->cur_element_count;
+  hdr->size_per_element = alg->size_data_per_element_;
+  hdr->label_offset = alg->label_offset_;
+  hdr->offset_data = alg->offsetData_;
+  hdr->max_level = alg->maxlevel_;
+  hdr->entry_point = alg->enterpoint_node_;
+  hdr->max_m = alg->maxM_;
+  hdr->max_m0 = alg->maxM0_;
+  hdr->m = alg->M_;
+  hdr->mult = alg->mult_;
+  hdr->ef_construction = alg->ef_construction_;
+}
+
+char *getHNSWLevel0(HNSW index) {
+  return ((HierarchicalNSW*)index)->data_level0_memory_;
+}
+
+char *getHNSWLinkList(HNSW index, unsigned long int id, unsigned int *size) {
+  HierarchicalNSW *alg = (HierarchicalNSW*)index;
+  int levels = alg->element_levels_[id];
+  *size = levels > 0 ? alg->size_links_per_element_ * levels : 0;
+  return alg->linkLists_[id];
+}
+
+// allocHNSW sets up what loadIndex does, minus the reading.
+HNSW allocHNSW(HNSWHeader *hdr, int dim, char stype, HNSWError *err) {
+  hnswlib::SpaceInterface<float> *space = NULL;
+  HierarchicalNSW *alg = NULL;
+  try {
+    space = newSpace(dim, stype);
+    if (hdr->label_offset - hdr->offset_data != space->get_data_size() || hdr->count > hdr->max_elements) {
+      delete space;
+      setError(err, HNSW_ERR_IO, "Index seems to be corrupted or unsupported");
+      return NULL;
+    }
+
+    // the bare constructor leaves every member unset; set those the
+    // destructor reads before anything can throw
+    alg = new HierarchicalNSW(space);
+    alg->data_level0_memory_ = NULL;
+    alg->linkLists_ = NULL;
+    alg->visited_list_pool_ = NULL;
+    alg->cur_element_count = 0;
+
+    size_t max_elements = hdr->max_elements;
+    alg->offsetLevel0_ = hdr->offset_level0;
+    alg->max_elements_ = max_elements;
+    alg->size_data_per_element_ = hdr->size_per_element;
+    alg->label_offset_ = hdr->label_offset;
+    alg->offsetData_ = hdr->offset_data;
+    alg->maxlevel_ = hdr->max_level;
+    alg->enterpoint_node_ = hdr->entry_point;
+    alg->maxM_ = hdr->max_m;
+    alg->maxM0_ = hdr->max_m0;
+    alg->M_ = hdr->m;
+    alg->mult_ = hdr->mult;
+    alg->ef_construction_ = hdr->ef_construction;
+
+    alg->data_size_ = space->get_data_size();
+    alg->fstdistfunc_ = space->get_dist_func();
+    alg->dist_func_param_ = space->get_dist_func_param();
+    alg->size_links_per_element_ = alg->maxM_ * sizeof(hnswlib::tableint) + sizeof(hnswlib::linklistsizeint);
+    alg->size_links_level0_ = alg->maxM0_ * sizeof(hnswlib::tableint) + sizeof(hnswlib::linklistsizeint);
+    std::vector<std::mutex>(max_elements).swap(alg->link_list_locks_);
+    std::vector<std::mutex>(HierarchicalNSW::max_update_element_locks).swap(alg->link_list_update_locks_);
+    alg->element_levels_ = std::vector<int>(max_elements);
+    alg->revSize_ = 1.0 / alg->mult_;
+    alg->ef_ = 10;
+    alg->has_deletions_ = false;
+
+    alg->data_level0_memory_ = (char *) malloc(max_elements * alg->size_data_per_element_);
+    alg->linkLists_ = (char **) calloc(max_elements, sizeof(void *));
+    if (alg->data_level0_memory_ == NULL || alg->linkLists_ == NULL) {
+      throw std::bad_alloc();
+    }
+    alg->visited_list_pool_ = new hnswlib::VisitedListPool(1, max_elements);
+    alg->cur_element_count = hdr->count;
+    return (void*)alg;
+  } catch (...) {
+    delete alg;
+    delete space;
+    handleException(err);
+    return NULL;
+  }
+}
+
+char *allocHNSWLinkList(HNSW index, unsigned long int id, unsigned int size, HNSWError *err) {
+  HierarchicalNSW *alg = (HierarchicalNSW*)index;
+  if (id >= alg->cur_element_count || size == 0 || size % alg->size_links_per_element_ != 0) {
+    setError(err, HNSW_ERR_IO, "Index seems to be corrupted or unsupported");
+    return NULL;
+  }
+  char *links = (char *) malloc(size);
+  if (links == NULL) {
+    setError(err, HNSW_ERR_MEMORY, "Not enough memory: failed to allocate linklist");
+    return NULL;
+  }
+  alg->linkLists_[id] = links;
+  alg->element_levels_[id] = size / alg->size_links_per_element_;
+  return links;
+}
+
+// finishHNSW checks every link, which loadIndex does not: a neighbour out of
+// range or missing from the level it is linked on crashes searches.
+int finishHNSW(HNSW index, HNSWError *err) {
+  HierarchicalNSW *alg = (HierarchicalNSW*)index;
+  size_t count = alg->cur_element_count;
+  try {
+    for (size_t i = 0; i < count; i++) {
+      for (int level = 0; level <= alg->element_levels_[i]; level++) {
+        hnswlib::linklistsizeint *ll = level == 0 ? alg->get_linklist0(i) : alg->get_linklist(i, level);
+        size_t size = alg->getListCount(ll);
+        if (size > (level == 0 ? alg->maxM0_ : alg->maxM_)) {
+          return setError(err, HNSW_ERR_IO, "Index seems to be corrupted or unsupported");
+        }
+        hnswlib::tableint *neighbours = (hnswlib::tableint *)(ll + 1);
+        for (size_t j = 0; j < size; j++) {
+          if (neighbours[j] >= count || alg->element_levels_[neighbours[j]] < level) {
+            return setError(err, HNSW_ERR_IO, "Index seems to be corrupted or unsupported");
+          }
+        }
+      }
+    }
+    if (count == 0) {
+      alg->maxlevel_ = -1;
+      alg->enterpoint_node_ = -1;
+    } else if (alg->enterpoint_node_ >= count || alg->element_levels_[alg->enterpoint_node_] != alg->maxlevel_) {
+      return setError(err, HNSW_ERR_IO, "Index seems to be corrupted or unsupported");
+    }
+
+    for (size_t i = 0; i < count; i++) {
+      alg->label_lookup_[alg->getExternalLabel(i)] = i;
+      if (alg->isMarkedDeleted(i)) {
+        alg->has_deletions_ = true;
+      }
+    }
+  } catch (...) {
+    return handleException(err);
+  }
+  return HNSW_OK;
+}
+
+// The vendored BruteforceSearch does not own its space, rebuild its label map
+// on load, bound k in searchKnn, check labels in removePoint or resize. The
+// functions below make up for that without touching hnswlib.
+
+typedef hnswlib::BruteforceSearch<float> BruteforceSearch;
+
+struct bruteforce {
+  hnswlib::SpaceInterface<float> *space;
+  BruteforceSearch *alg;
+};
+
+static hnswlib::labeltype bruteforceLabel(const BruteforceSearch *alg, size_t i) {
+  return *(hnswlib::labeltype *)(alg->data_ + alg->size_per_element_ * i + alg->data_size_);
+}
+
+// clearBruteforce zeroes the records [from, to). saveIndex writes every
+// record up to maxelements_, unused ones must not hold stale or heap data.
+static void clearBruteforce(BruteforceSearch *alg, size_t from, size_t to) {
+  memset(alg->data_ + alg->size_per_element_ * from, 0, alg->size_per_element_ * (to - from));
+}
+
+Bruteforce initBruteforce(int dim, unsigned long int max_elements, char stype, HNSWError *err) {
+  bruteforce *bf = new (std::nothrow) bruteforce();
+  if (bf == NULL) {
+    setError(err, HNSW_ERR_MEMORY, "Not enough memory");
+    return NULL;
+  }
+  try {
+    bf->space = newSpace(dim, stype);
+    bf->alg = new BruteforceSearch(bf->space, std::max(max_elements, 1ul));
+    if (bf->alg->data_ == NULL) {
+      throw std::bad_alloc();
+    }
+    clearBruteforce(bf->alg, 0, bf->alg->maxelements_);
+    return (void*)bf;
+  } catch (...) {
+    handleException(err);
+    freeBruteforce(bf);
+    return NULL;
+  }
+}
+
+Bruteforce loadBruteforce(char *location, int dim, char stype, HNSWError *err) {
+  bruteforce *bf = new (std::nothrow) bruteforce();
+  if (bf == NULL) {
+    setError(err, HNSW_ERR_MEMORY, "Not enough memory");
+    return NULL;
+  }
+  try {
+    bf->space = newSpace(dim, stype);
+    {
+      // loadIndex trusts the file blindly, so check its header and size first
+      std::ifstream probe(location, std::ios::binary);
+      if (!probe.is_open()) {
+        throw std::runtime_error("Cannot open file");
+      }
+      size_t max_elements, size_per_element, count;
+      hnswlib::readBinaryPOD(probe, max_elements);
+      hnswlib::readBinaryPOD(probe, size_per_element);
+      hnswlib::readBinaryPOD(probe, count);
+      probe.seekg(0, probe.end);
+      if (!probe || size_per_element != bf->space->get_data_size() + sizeof(hnswlib::labeltype) || count > max_elements ||
+          (size_t)probe.tellg() != 3 * sizeof(size_t) + max_elements * size_per_element) {
+        throw std::runtime_error("Index seems to be corrupted or unsupported");
+      }
+    }
+    bf->alg = new BruteforceSearch(bf->space);
+    bf->alg->data_ = NULL;
+    bf->alg->loadIndex(location, bf->space);
+    if (bf->alg->data_ == NULL) {
+      throw std::bad_alloc();
+    }
+    for (size_t i = 0; i < bf->alg->cur_element_count; i++) {
+      bf->alg->dict_external_to_internal[bruteforceLabel(bf->alg, i)] = i;
+    }
+    clearBruteforce(bf->alg, bf->alg->cur_element_count, bf->alg->maxelements_);
+    return (void*)bf;
+  } catch (...) {
+    handleException(err);
+    freeBruteforce(bf);
+    return NULL;
+  }
+}
+
+int saveBruteforce(Bruteforce index, char *location, HNSWError *err) {
+  try {
+    {
+      std::ofstream probe(location, std::ios::binary | std::ios::app);
+      if (!probe.is_open()) {
+        return setError(err, HNSW_ERR_IO, "Cannot open file");
+      }
+    }
+    ((bruteforce*)index)->alg->saveIndex(location);
+  } catch (...) {
+    return handleException(err);
+  }
+  return HNSW_OK;
+}
+
+void freeBruteforce(Bruteforce index) {
+  bruteforce *bf = (bruteforce*)index;
+  delete bf->alg;
+  delete bf->space;
+  delete bf;
+}
+
+int bruteforceAddPoint(Bruteforce index, float *vec, unsigned long int label, HNSWError *err) {
+  try {
+    ((bruteforce*)index)->alg->addPoint(vec, label);
+  } catch (...) {
+    return handleException(err);
+  }
+  return HNSW_OK;
+}
+
+int bruteforceRemovePoint(Bruteforce index, unsigned long int label, HNSWError *err) {
+  BruteforceSearch *alg = ((bruteforce*)index)->alg;
+  if (alg->dict_external_to_internal.find(label) == alg->dict_external_to_internal.end()) {
+    return setError(err, HNSW_ERR_UNKNOWN_LABEL, "Label not found");
+  }
+  try {
+    alg->removePoint(label);
+    clearBruteforce(alg, alg->cur_element_count, alg->cur_element_count + 1);
+  } catch (...) {
+    return handleException(err);
+  }
+  return HNSW_OK;
+}
+
+// bruteforceSearchWith scans every element, keeping the k closest allowed
+// ones. Results are written closest first; the count is returned.
+static int bruteforceSearchWith(const BruteforceSearch *alg, const void *query_data, size_t k, const uint64_t *allow, size_t allow_words, unsigned long int *label, float *dist) {
+  std::priority_queue<std::pair<float, hnswlib::labeltype>> top;
+  for (size_t i = 0; i < alg->cur_element_count && k > 0; i++) {
+    hnswlib::labeltype l = bruteforceLabel(alg, i);
+    if (!isAllowed(allow, allow_words, l)) {
+      continue;
+    }
+    float d = alg->fstdistfunc_(query_data, alg->data_ + alg->size_per_element_ * i, alg->dist_func_param_);
+    if (top.size() < k || d < top.top().first) {
+      top.emplace(d, l);
+      if (top.size() > k) {
+        top.pop();
+      }
+    }
+  }
+
+  int n = top.size();
+  for (int i = n - 1; i >= 0; i--) {
+    *(dist+i) = top.top().first;
+    *(label+i) = top.top().second;
+    top.pop();
+  }
+  return n;
+}
+
+int bruteforceSearchKnn(Bruteforce index, float *vec, int N, uint64_t *allow, unsigned long int allow_words, unsigned long int *label, float *dist, HNSWError *err) {
+  try {
+    return bruteforceSearchWith(((bruteforce*)index)->alg, vec, N, allow, allow_words, label, dist);
+  } catch (...) {
+    handleException(err);
+    return -1;
+  }
+}
+
+int bruteforceSearchKnnBatch(Bruteforce index, float *vecs, unsigned long int n, int N, int num_threads, unsigned long int *labels, float *dists, int *counts, HNSWError *err) {
+  BruteforceSearch *alg = ((bruteforce*)index)->alg;
+  size_t dim = *(size_t *)alg->dist_func_param_;
+  try {
+    parallelFor(n, num_threads, [&](size_t i) {
+      counts[i] = bruteforceSearchWith(alg, vecs + i * dim, N, NULL, 0, labels + i * N, dists + i * N);
+    });
+  } catch (...) {
+    return handleException(err);
+  }
+  return HNSW_OK;
+}
+
+int bruteforceResize(Bruteforce index, unsigned long int new_max_elements, HNSWError *err) {
+  BruteforceSearch *alg = ((bruteforce*)index)->alg;
+  if (new_max_elements < alg->cur_element_count) {
+    return setError(err, HNSW_ERR_CAPACITY, "Cannot resize, max element is less than the current number of elements");
+  }
+  char *data = (char *) realloc(alg->data_, new_max_elements * alg->size_per_element_);
+  if (data == NULL) {
+    return setError(err, HNSW_ERR_MEMORY, "Not enough memory: resize failed to allocate data");
+  }
+  alg->data_ = data;
+  if (new_max_elements > alg->maxelements_) {
+    clearBruteforce(alg, alg->maxelements_, new_max_elements);
+  }
+  alg->maxelements_ = new_max_elements;
+  return HNSW_OK;
+}
+
+unsigned long int getBruteforceMaxElements(Bruteforce index) {
+  return ((bruteforce*)index)->alg->maxelements_;
+}
+
+unsigned long int getBruteforceCount(Bruteforce index) {
+  return ((bruteforce*)index)->alg->cur_element_count;
+}
+
+int bruteforceGetDataByLabel(Bruteforce index, unsigned long int label, float *vec, HNSWError *err) {
+  BruteforceSearch *alg = ((bruteforce*)index)->alg;
+  auto search = alg->dict_external_to_internal.find(label);
+  if (search == alg->dict_external_to_internal.end()) {
+    return setError(err, HNSW_ERR_UNKNOWN_LABEL, "Label not found");
+  }
+  memcpy(vec, alg->data_ + alg->size_per_element_ * search->second, alg->data_size_);
+  return HNSW_OK;
+}
+
+char *getBruteforceData(Bruteforce index) {
+  return ((bruteforce*)index)->alg->data_;
+}
+
+int finishBruteforce(Bruteforce index, unsigned long int count, HNSWError *err) {
+  BruteforceSearch *alg = ((bruteforce*)index)->alg;
+  if (count > alg->maxelements_) {
+    return setError(err, HNSW_ERR_IO, "Index seems to be corrupted or unsupported");
+  }
+  try {
+    alg->cur_element_count = count;
+    for (size_t i = 0; i < count; i++) {
+      alg->dict_external_to_internal[bruteforceLabel(alg, i)] = i;
+    }
+    clearBruteforce(alg, count, alg->maxelements_);
+  } catch (...) {
+    return handleException(err);
+  }
+  return HNSW_OK;
+}
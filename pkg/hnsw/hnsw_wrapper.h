@@ -1,15 +1,90 @@
 // hnsw_wrapper.h
+#include <stdint.h>
+
 #ifdef __cplusplus
 extern "C" {
 #endif
+  #define HNSW_OK 0
+  #define HNSW_ERR_UNKNOWN 1
+  #define HNSW_ERR_CAPACITY 2
+  #define HNSW_ERR_UNKNOWN_LABEL 3
+  #define HNSW_ERR_IO 4
+  #define HNSW_ERR_MEMORY 5
+
+  #define HNSW_ERR_MSG_SIZE 256
+
+  typedef struct {
+    int code;
+    char message[HNSW_ERR_MSG_SIZE];
+  } HNSWError;
+
   typedef void* HNSW;
-  HNSW initHNSW(int dim, unsigned long int max_elements, int M, int ef_construction, int rand_seed, char stype);
-  HNSW loadHNSW(char *location, int dim, char stype);
-  HNSW saveHNSW(HNSW index, char *location);
+  HNSW initHNSW(int dim, unsigned long int max_elements, int M, int ef_construction, int rand_seed, char stype, HNSWError *err);
+  HNSW loadHNSW(char *location, int dim, char stype, HNSWError *err);
+  int saveHNSW(HNSW index, char *location, HNSWError *err);
   void freeHNSW(HNSW index);
-  void addPoint(HNSW index, float *vec, unsigned long int label);
-  int searchKnn(HNSW index, float *vec, int N, unsigned long int *label, float *dist);
+  int addPoint(HNSW index, float *vec, unsigned long int label, HNSWError *err);
+  int searchKnn(HNSW index, float *vec, int N, unsigned long int *label, float *dist, HNSWError *err);
   void setEf(HNSW index, int ef);
+  int markDelete(HNSW index, unsigned long int label, HNSWError *err);
+  int unmarkDelete(HNSW index, unsigned long int label, HNSWError *err);
+  int resizeIndex(HNSW index, unsigned long int new_max_elements, HNSWError *err);
+  unsigned long int getMaxElements(HNSW index);
+  unsigned long int getCurrentCount(HNSW index);
+  int getDataByLabel(HNSW index, unsigned long int label, float *vec, HNSWError *err);
+  int searchKnnEf(HNSW index, float *vec, int N, int ef, unsigned long int *label, float *dist, HNSWError *err);
+  int searchKnnFiltered(HNSW index, float *vec, int N, int ef, uint64_t *allow, unsigned long int allow_words, unsigned long int *label, float *dist, HNSWError *err);
+  int searchKnnAmong(HNSW index, float *vec, int N, unsigned long int *candidates, unsigned long int n_candidates, unsigned long int *label, float *dist, HNSWError *err);
+  int searchKnnExact(HNSW index, float *vec, int N, unsigned long int *label, float *dist, HNSWError *err);
+  int addPoints(HNSW index, float *vecs, unsigned long int *labels, unsigned long int n, int num_threads, int *codes, HNSWError *err);
+  int searchKnnBatch(HNSW index, float *vecs, unsigned long int n, int N, int num_threads, unsigned long int *labels, float *dists, int *counts, HNSWError *err);
+
+  // HNSWHeader is the header saveIndex writes. The functions below let Go
+  // stream an index in the saveIndex format.
+  typedef struct {
+    uint64_t offset_level0;
+    uint64_t max_elements;
+    uint64_t count;
+    uint64_t size_per_element;
+    uint64_t label_offset;
+    uint64_t offset_data;
+    int32_t max_level;
+    uint32_t entry_point;
+    uint64_t max_m;
+    uint64_t max_m0;
+    uint64_t m;
+    double mult;
+    uint64_t ef_construction;
+  } HNSWHeader;
+  void getHNSWHeader(HNSW index, HNSWHeader *hdr);
+  char *getHNSWLevel0(HNSW index);
+  char *getHNSWLinkList(HNSW index, unsigned long int id, unsigned int *size);
+  // allocHNSW, allocHNSWLinkList and finishHNSW build an index from a header:
+  // the caller fills the memory they return, then finishHNSW checks the links
+  // and indexes the labels. On error the index must still be freed.
+  HNSW allocHNSW(HNSWHeader *hdr, int dim, char stype, HNSWError *err);
+  char *allocHNSWLinkList(HNSW index, unsigned long int id, unsigned int size, HNSWError *err);
+  int finishHNSW(HNSW index, HNSWError *err);
+
+  // Bruteforce wraps hnswlib::BruteforceSearch, an exact index. Calls that
+  // change it must not run alongside any other call on the same index.
+  typedef void* Bruteforce;
+  Bruteforce initBruteforce(int dim, unsigned long int max_elements, char stype, HNSWError *err);
+  Bruteforce loadBruteforce(char *location, int dim, char stype, HNSWError *err);
+  int saveBruteforce(Bruteforce index, char *location, HNSWError *err);
+  void freeBruteforce(Bruteforce index);
+  int bruteforceAddPoint(Bruteforce index, float *vec, unsigned long int label, HNSWError *err);
+  int bruteforceRemovePoint(Bruteforce index, unsigned long int label, HNSWError *err);
+  int bruteforceSearchKnn(Bruteforce index, float *vec, int N, uint64_t *allow, unsigned long int allow_words, unsigned long int *label, float *dist, HNSWError *err);
+  int bruteforceSearchKnnBatch(Bruteforce index, float *vecs, unsigned long int n, int N, int num_threads, unsigned long int *labels, float *dists, int *counts, HNSWError *err);
+  int bruteforceResize(Bruteforce index, unsigned long int new_max_elements, HNSWError *err);
+  unsigned long int getBruteforceMaxElements(Bruteforce index);
+  unsigned long int getBruteforceCount(Bruteforce index);
+  int bruteforceGetDataByLabel(Bruteforce index, unsigned long int label, float *vec, HNSWError *err);
+  // getBruteforceData returns the max_elements records saveIndex writes
+  // after its header. finishBruteforce takes count records filled through it.
+  char *getBruteforceData(Bruteforce index);
+  int finishBruteforce(Bruteforce index, unsigned long int count, HNSWError *err);
 #ifdef __cplusplus
 }
 #endif
@@ -0,0 +1,113 @@
+package hnswgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+var errCorrupted = &Error{Code: CodeIO, Message: "Index seems to be corrupted or unsupported"}
+
+// indexHeader is the header of an hnswlib index file, field for field.
+type indexHeader struct {
+	OffsetLevel0   uint64
+	MaxElements    uint64
+	Count          uint64
+	SizePerElement uint64
+	LabelOffset    uint64
+	OffsetData     uint64
+	MaxLevel       int32
+	EntryPoint     uint32
+	MaxM           uint64
+	MaxM0          uint64
+	M              uint64
+	Mult           float64
+	EFConstruction uint64
+}
+
+// check validates the layout the header describes against dim.
+func (hdr *indexHeader) check(dim int) error {
+	linksSize0 := hdr.MaxM0*4 + 4
+	if hdr.OffsetLevel0 != 0 || hdr.OffsetData != linksSize0 || hdr.LabelOffset < hdr.OffsetData ||
+		hdr.SizePerElement != hdr.LabelOffset+8 || hdr.Count > hdr.MaxElements || hdr.MaxElements > math.MaxUint32 ||
+		hdr.MaxM0 >= 1<<16 || hdr.MaxM >= 1<<16 || hdr.MaxLevel >= 1<<16 {
+		return errCorrupted
+	}
+	if hdr.LabelOffset-hdr.OffsetData != uint64(dim)*4 {
+		return &Error{Code: CodeIO, Message: "index dimension does not match"}
+	}
+	return nil
+}
+
+// bruteforceHeader is the header of a BruteforceSearch file. The header is
+// followed by MaxElements records of the vector and a 64 bit label, unused
+// ones included.
+type bruteforceHeader struct {
+	MaxElements    uint64
+	SizePerElement uint64
+	Count          uint64
+}
+
+func (hdr *bruteforceHeader) check(dim int) error {
+	if hdr.SizePerElement != uint64(dim)*4+8 || hdr.Count > hdr.MaxElements || hdr.MaxElements > math.MaxUint32 {
+		return errCorrupted
+	}
+	return nil
+}
+
+// readError maps an error reading an index stream to an Error. A stream
+// ending early is a corrupted index.
+func readError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errCorrupted
+	}
+	return &Error{Code: CodeIO, Message: err.Error()}
+}
+
+// streamChunk bounds single writes, so that writers counting progress see
+// large indexes advance steadily.
+const streamChunk = 1 << 20
+
+// countWriter counts the bytes written to w and keeps the first error, so
+// that WriteTo can write without checking each call.
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+func (cw *countWriter) writeChunked(p []byte) {
+	for len(p) > 0 && cw.err == nil {
+		n := len(p)
+		if n > streamChunk {
+			n = streamChunk
+		}
+		cw.Write(p[:n])
+		p = p[n:]
+	}
+}
+
+func (cw *countWriter) writeValue(v any) {
+	if cw.err == nil {
+		cw.err = binary.Write(cw, binary.LittleEndian, v)
+	}
+}
+
+// result returns what WriteTo returns.
+func (cw *countWriter) result() (int64, error) {
+	if cw.err != nil {
+		return cw.n, &Error{Code: CodeIO, Message: cw.err.Error()}
+	}
+	return cw.n, nil
+}
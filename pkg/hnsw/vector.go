@@ -0,0 +1,33 @@
+package hnswgo
+
+import "github.com/chewxy/math32"
+
+// normalizeVector returns a normalized copy, leaving the caller's slice alone.
+func normalizeVector(vector []float32) []float32 {
+	var norm float32
+	for i := 0; i < len(vector); i++ {
+		norm += vector[i] * vector[i]
+	}
+	norm = 1.0 / (math32.Sqrt(norm) + 1e-15)
+	out := make([]float32, len(vector))
+	for i := 0; i < len(vector); i++ {
+		out[i] = vector[i] * norm
+	}
+	return out
+}
+
+// flatten copies vectors into one contiguous buffer, normalizing them for
+// cosine indexes.
+func flatten(dim int, normalize bool, vectors [][]float32) ([]float32, error) {
+	flat := make([]float32, 0, len(vectors)*dim)
+	for _, vector := range vectors {
+		if len(vector) != dim {
+			return nil, ErrDimensionMismatch
+		}
+		if normalize {
+			vector = normalizeVector(vector)
+		}
+		flat = append(flat, vector...)
+	}
+	return flat, nil
+}
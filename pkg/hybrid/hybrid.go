@@ -0,0 +1,167 @@
+package hybrid
+
+import (
+	"sort"
+
+	"github.com/abilitylab/graph/pkg/graph"
+	"github.com/abilitylab/graph/pkg/metadata"
+)
+
+// TextSearcher ranks stored texts against a keyword query, best first, as
+// *inmemory.Service does with BM25.
+type TextSearcher interface {
+	SearchText(query []byte, k int, opts graph.SearchOptions) []graph.Result
+}
+
+// VectorSearcher is the vector side of a hybrid search, any backend of
+// package index.
+type VectorSearcher interface {
+	SearchWithOptions(vector []float32, k int, opts graph.SearchOptions) ([]graph.Result, error)
+}
+
+type Fusion int
+
+const (
+	// FusionRRF scores a result weight/(RRFK+rank) per signal, ranks starting
+	// at 1. It only looks at ranks, so the scales of the signals do not matter.
+	FusionRRF Fusion = iota
+	// FusionLinear scales the scores of each signal to (0, 1] over its
+	// candidates, best to worst, and sums them weighted. A signal that did
+	// not return a result adds 0.
+	FusionLinear
+)
+
+const (
+	defaultRRFK = 60
+	// defaultCandidates is how many results each signal contributes, as a
+	// multiple of k.
+	defaultCandidates = 4
+	// minNormalized is what FusionLinear scales the worst candidate to, so
+	// that it still beats a result the signal did not return.
+	minNormalized = 0.01
+)
+
+type Options struct {
+	Fusion Fusion
+	// TextWeight and VectorWeight weight the signals. Both zero means equal
+	// weights.
+	TextWeight   float32
+	VectorWeight float32
+	// RRFK is the rank constant of FusionRRF. Zero means 60.
+	RRFK int
+	// Candidates is the number of results fetched from each signal before
+	// fusion. Zero means 4*k.
+	Candidates int
+	// Search applies to both searches. graph.Service stores no text and
+	// rejects Contains.
+	Search graph.SearchOptions
+}
+
+// Result is a fused result. TextScore and VectorScore are the scores the
+// signals gave, TextRank and VectorRank the positions, from 1, the result
+// had in them; all are zero for a signal that did not return it.
+type Result struct {
+	ID          string             `json:"id"`
+	Score       float32            `json:"score"`
+	TextScore   float32            `json:"textScore"`
+	TextRank    int                `json:"textRank,omitempty"`
+	VectorScore float32            `json:"vectorScore"`
+	VectorRank  int                `json:"vectorRank,omitempty"`
+	Metadata    *metadata.Metadata `json:"metadata,omitempty"`
+}
+
+// Search runs the keyword search of query on text and the nearest neighbour
+// search of vector on vectors, then fuses the two rankings into up to k
+// results, best first, ties ordered by ID. An empty query or vector leaves
+// its signal out, and its searcher may then be nil.
+func Search(text TextSearcher, vectors VectorSearcher, query []byte, vector []float32, k int, opts Options) ([]Result, error) {
+	if k <= 0 {
+		return nil, nil
+	}
+
+	candidates := opts.Candidates
+	if candidates <= 0 {
+		candidates = defaultCandidates * k
+	}
+	textWeight, vectorWeight := opts.TextWeight, opts.VectorWeight
+	if textWeight == 0 && vectorWeight == 0 {
+		textWeight, vectorWeight = 1, 1
+	}
+	rrfK := opts.RRFK
+	if rrfK <= 0 {
+		rrfK = defaultRRFK
+	}
+
+	var textResults, vectorResults []graph.Result
+	if len(query) > 0 {
+		textResults = text.SearchText(query, candidates, opts.Search)
+	}
+	if len(vector) > 0 {
+		var err error
+		vectorResults, err = vectors.SearchWithOptions(vector, candidates, opts.Search)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fused := make(map[string]*Result, len(textResults)+len(vectorResults))
+	get := func(r graph.Result) *Result {
+		result, found := fused[r.ID]
+		if !found {
+			result = &Result{ID: r.ID, Metadata: r.Metadata}
+			fused[r.ID] = result
+		}
+		return result
+	}
+
+	textNorm := normalizer(textResults)
+	for i, r := range textResults {
+		result := get(r)
+		result.TextScore, result.TextRank = r.Score, i+1
+		result.Score += fuse(opts.Fusion, textWeight, rrfK, i+1, textNorm(r.Score))
+	}
+	vectorNorm := normalizer(vectorResults)
+	for i, r := range vectorResults {
+		result := get(r)
+		result.VectorScore, result.VectorRank = r.Score, i+1
+		result.Score += fuse(opts.Fusion, vectorWeight, rrfK, i+1, vectorNorm(r.Score))
+	}
+
+	results := make([]Result, 0, len(fused))
+	for _, result := range fused {
+		results = append(results, *result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	if len(results) > k {
+		results = results[:k]
+	}
+
+	return results, nil
+}
+
+func fuse(fusion Fusion, weight float32, rrfK, rank int, normalized float32) float32 {
+	if fusion == FusionLinear {
+		return weight * normalized
+	}
+	return weight / float32(rrfK+rank)
+}
+
+// normalizer returns the min-max scaling of the scores of results, which come
+// best first, to [minNormalized, 1]. A single score, or all equal, scale to 1.
+func normalizer(results []graph.Result) func(score float32) float32 {
+	if len(results) == 0 {
+		return nil
+	}
+	best, worst := results[0].Score, results[len(results)-1].Score
+	if best == worst {
+		return func(float32) float32 { return 1 }
+	}
+	return func(score float32) float32 {
+		return (score-worst)/(best-worst)*(1-minNormalized) + minNormalized
+	}
+}
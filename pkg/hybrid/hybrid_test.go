@@ -0,0 +1,80 @@
+package hybrid
+
+import (
+	"testing"
+
+	"github.com/abilitylab/graph/pkg/graph"
+	"github.com/abilitylab/graph/pkg/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+func resultIDs(results []Result) []string {
+	ids := make([]string, len(results))
+	for i, r := range results {
+		ids[i] = r.ID
+	}
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	text := inmemory.New(&inmemory.Configuration{Dim: 2, SpaceType: graph.SpaceTypeCosine})
+	require.NoError(t, text.Put("east", []byte("election results"), []float32{1, 0}))
+	require.NoError(t, text.Put("north-east", []byte("election election night"), []float32{1, 1}))
+	require.NoError(t, text.Put("north", []byte("weather"), []float32{0, 1}))
+
+	vectors, err := graph.New(&graph.Configuration{Dim: 2, M: 16, EFConstruction: 100, SpaceType: graph.SpaceTypeCosine})
+	require.NoError(t, err)
+	require.NoError(t, vectors.Put("east", []float32{1, 0}))
+	require.NoError(t, vectors.Put("north-east", []float32{1, 1}))
+	require.NoError(t, vectors.Put("north", []float32{0, 1}))
+
+	query, vector := []byte("election"), []float32{0.2, 1}
+
+	// north-east is second on both signals, east and north first on one each
+	results, err := Search(text, vectors, query, vector, 3, Options{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"north-east", "east", "north"}, resultIDs(results))
+	require.Equal(t, 1, results[0].TextRank)
+	require.Equal(t, 2, results[0].VectorRank)
+	require.Positive(t, results[0].TextScore)
+	require.Positive(t, results[0].VectorScore)
+	require.InDelta(t, 1.0/61+1.0/62, results[0].Score, 1e-6)
+	require.Zero(t, results[2].TextRank)
+	require.Zero(t, results[2].TextScore)
+
+	results, err = Search(text, vectors, query, vector, 3, Options{Fusion: FusionLinear, VectorWeight: 1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"north", "north-east", "east"}, resultIDs(results))
+	require.InDelta(t, 1, results[0].Score, 1e-6)
+	require.InDelta(t, minNormalized, results[2].Score, 1e-6)
+
+	// east is the worst of both signals, scaled to minNormalized on each
+	results, err = Search(text, vectors, query, vector, 3, Options{Fusion: FusionLinear, TextWeight: 3, VectorWeight: 1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"north-east", "north", "east"}, resultIDs(results))
+	require.InDelta(t, 4*minNormalized, results[2].Score, 1e-6)
+
+	// a single signal keeps its own order
+	results, err = Search(text, nil, query, nil, 1, Options{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"north-east"}, resultIDs(results))
+	// the inmemory backend leaves out east, past its distance cutoff
+	results, err = Search(text, text, nil, vector, 10, Options{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"north", "north-east"}, resultIDs(results))
+
+	_, err = Search(text, vectors, query, vector, 3, Options{Search: graph.SearchOptions{Contains: [][]byte{query}}})
+	require.ErrorIs(t, err, graph.ErrUnsupportedOption)
+}
+
+func TestNormalizer(t *testing.T) {
+	normalize := normalizer([]graph.Result{{Score: 3}, {Score: 2}, {Score: 1}})
+	require.InDelta(t, 1, normalize(3), 1e-6)
+	require.InDelta(t, 0.505, normalize(2), 1e-6)
+	// the worst candidate still beats a result the signal did not return
+	require.InDelta(t, minNormalized, normalize(1), 1e-6)
+
+	normalize = normalizer([]graph.Result{{Score: 0.5}, {Score: 0.5}})
+	require.Equal(t, float32(1), normalize(0.5))
+	require.Nil(t, normalizer(nil))
+}
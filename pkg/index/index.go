@@ -0,0 +1,62 @@
+package index
+
+import (
+	"fmt"
+
+	"github.com/abilitylab/graph/pkg/graph"
+	"github.com/abilitylab/graph/pkg/inmemory"
+)
+
+type (
+	Result        = graph.Result
+	SearchOptions = graph.SearchOptions
+	PutOption     = graph.PutOption
+)
+
+// Index is the surface shared by the vector backends, so services can pick
+// one from configuration and keep a single code path.
+type Index interface {
+	Upsert(id string, vector []float32, opts ...PutOption) error
+	Delete(id string) error
+	Get(id string) ([]float32, bool)
+	GetMany(ids []string) map[string][]float32
+	SearchWithOptions(vector []float32, k int, opts SearchOptions) ([]Result, error)
+	SearchByID(id string, k int, opts SearchOptions) ([]Result, error)
+	SearchRadius(vector []float32, radius float32, limit int) ([]Result, error)
+	Count() int
+	Range(fn func(id string) bool)
+}
+
+var (
+	_ Index = (*graph.Service)(nil)
+	_ Index = (*inmemory.Service)(nil)
+)
+
+type Backend string
+
+const (
+	BackendHNSW       Backend = "hnsw"
+	BackendBruteForce Backend = "bruteforce"
+)
+
+// Configuration selects a backend. Only the section matching Backend is used.
+type Configuration struct {
+	Backend    Backend
+	HNSW       graph.Configuration
+	BruteForce inmemory.Configuration
+}
+
+func New(cfg *Configuration) (Index, error) {
+	switch cfg.Backend {
+	case BackendHNSW, "":
+		s, err := graph.New(&cfg.HNSW)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case BackendBruteForce:
+		return inmemory.New(&cfg.BruteForce), nil
+	default:
+		return nil, fmt.Errorf("index: unknown backend %q", cfg.Backend)
+	}
+}
@@ -0,0 +1,78 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/abilitylab/graph/pkg/graph"
+	"github.com/abilitylab/graph/pkg/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackends(t *testing.T) {
+	for _, backend := range []Backend{BackendHNSW, BackendBruteForce} {
+		t.Run(string(backend), func(t *testing.T) {
+			idx, err := New(&Configuration{
+				Backend: backend,
+				HNSW: graph.Configuration{
+					Dim:            2,
+					M:              16,
+					EFConstruction: 100,
+					SpaceType:      graph.SpaceTypeCosine,
+				},
+				BruteForce: inmemory.Configuration{
+					Dim:       2,
+					SpaceType: graph.SpaceTypeCosine,
+				},
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, idx.Upsert("east", []float32{1, 0}))
+			require.NoError(t, idx.Upsert("north-east", []float32{1, 1}))
+			require.NoError(t, idx.Upsert("north", []float32{0, 1}))
+			require.Equal(t, 3, idx.Count())
+
+			vector, ok := idx.Get("east")
+			require.True(t, ok)
+			require.InDeltaSlice(t, []float32{1, 0}, vector, 1e-6)
+
+			vectors := idx.GetMany([]string{"east", "north", "missing"})
+			require.Len(t, vectors, 2)
+			require.InDeltaSlice(t, []float32{0, 1}, vectors["north"], 1e-6)
+
+			results, err := idx.SearchWithOptions([]float32{1, 0.1}, 2, SearchOptions{
+				Filter: func(id string) bool { return id != "east" },
+			})
+			require.NoError(t, err)
+			require.Equal(t, "north-east", results[0].ID)
+
+			results, err = idx.SearchByID("east", 1, SearchOptions{})
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			require.Equal(t, "north-east", results[0].ID)
+
+			_, err = idx.SearchByID("missing", 1, SearchOptions{})
+			require.ErrorIs(t, err, graph.ErrUnknownLabel)
+
+			// cos 45° leaves north-east at distance 0.29
+			results, err = idx.SearchRadius([]float32{1, 0}, 0.3, 0)
+			require.NoError(t, err)
+			require.Equal(t, []string{"east", "north-east"}, []string{results[0].ID, results[1].ID})
+			require.Len(t, results, 2)
+
+			results, err = idx.SearchRadius([]float32{1, 0}, 0.3, 1)
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+
+			require.NoError(t, idx.Delete("north-east"))
+			_, ok = idx.Get("north-east")
+			require.False(t, ok)
+
+			var ids []string
+			idx.Range(func(id string) bool {
+				ids = append(ids, id)
+				return true
+			})
+			require.ElementsMatch(t, []string{"east", "north"}, ids)
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package inmemory
+
+import (
+	"math"
+
+	"github.com/abilitylab/graph/pkg/graph"
+)
+
+// BM25 holds the parameters of text ranking. K1 sets how fast repeating a
+// term stops adding to the score, B how much long texts are penalized, from
+// 0 (not at all) to 1 (in proportion to their length). The zero value means
+// DefaultBM25.
+type BM25 struct {
+	K1 float32
+	B  float32
+}
+
+var DefaultBM25 = BM25{K1: 1.2, B: 0.75}
+
+// searchText ranks the points holding any of terms by their BM25 score, best
+// first, keeping those opts lets through.
+func (s *Service) searchText(opts graph.SearchOptions, terms []string, resultsNum int) ([]uint32, []float32) {
+	if resultsNum <= 0 || len(s.points) == 0 {
+		return nil, nil
+	}
+
+	n := float64(len(s.points))
+	avgLength := float64(s.totalLength) / n
+	k1, b := float64(s.bm25.K1), float64(s.bm25.B)
+
+	scores := make(map[uint32]float64)
+	for _, term := range terms {
+		postings := s.postings[term]
+		if len(postings) == 0 {
+			continue
+		}
+		df := float64(len(postings))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for _, posting := range postings {
+			length := float64(s.point(posting.innerLabel).length)
+			freq := float64(posting.freq)
+			scores[posting.innerLabel] += idf * freq * (k1 + 1) / (freq + k1*(1-b+b*length/avgLength))
+		}
+	}
+
+	match := s.queryMatch(opts.Query)
+	containsMatch := s.containsMatch(opts.Contains)
+	top := s.newTopK(resultsNum)
+	offer := func(innerLabel uint32, score float64) {
+		slot := s.slots[innerLabel]
+		if opts.Filter != nil && !opts.Filter(s.labelOuterMap[innerLabel]) {
+			return
+		}
+		if opts.Where != nil && !opts.Where.Match(s.points[slot].metadata) {
+			return
+		}
+		if containsMatch != nil && !containsMatch(slot) {
+			return
+		}
+		if match != nil && !match(slot) {
+			return
+		}
+		// the heap ranks by ascending distance
+		top.offer(candidate{slot: slot, dist: -float32(score)})
+	}
+
+	// contains and a query may match without any of terms: any point they
+	// match is ranked, scored or not
+	if len(opts.Contains) > 0 || opts.Query != nil {
+		slots, all := s.candidates(opts.Contains)
+		if all {
+			for slot := range s.points {
+				innerLabel := s.points[slot].innerLabel
+				offer(innerLabel, scores[innerLabel])
+			}
+		}
+		for _, slot := range slots {
+			innerLabel := s.points[slot].innerLabel
+			offer(innerLabel, scores[innerLabel])
+		}
+	} else {
+		for innerLabel, score := range scores {
+			offer(innerLabel, score)
+		}
+	}
+
+	best := top.sorted()
+	innerLabels := make([]uint32, len(best))
+	textScores := make([]float32, len(best))
+	for i, c := range best {
+		innerLabels[i] = s.points[c.slot].innerLabel
+		textScores[i] = -c.dist
+	}
+
+	return innerLabels, textScores
+}
+
+// SearchText ranks the stored points by the BM25 score of the terms of query
+// against their text, best first, leaving out the points holding none of
+// them unless opts.Contains or opts.Query is set: every point matching those
+// is ranked. Score is the BM25 score and Distance 1/(1+Score).
+func (s *Service) SearchText(query []byte, resultsNum int, opts graph.SearchOptions) []graph.Result {
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	return s.textResultsUnsafe(s.searchText(opts, s.queryTerms([][]byte{query}), resultsNum))
+}
+
+func (s *Service) textResultsUnsafe(innerLabels []uint32, scores []float32) []graph.Result {
+	results := make([]graph.Result, len(innerLabels))
+	for i, innerLabel := range innerLabels {
+		results[i] = graph.Result{
+			ID:       s.labelOuterMap[innerLabel],
+			Distance: 1 / (1 + scores[i]),
+			Score:    scores[i],
+			Metadata: s.point(innerLabel).metadata,
+		}
+	}
+	return results
+}
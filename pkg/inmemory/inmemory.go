@@ -2,16 +2,32 @@ package inmemory
 
 import (
 	"bytes"
-	"log"
 	"sync"
 
 	"github.com/abilitylab/graph/pkg/graph"
+	"github.com/abilitylab/graph/pkg/metadata"
+	"github.com/abilitylab/graph/pkg/query"
 )
 
 type Configuration struct {
 	Dim         int
 	MaxElements uint32
 	SpaceType   graph.SpaceType
+	// Substring makes a search's contains match any substring of the stored
+	// text, as bytes.Contains does, instead of its terms. The index still
+	// narrows down the candidates with Words, at the cost of a scan of the
+	// vocabulary per search.
+	Substring bool
+	// Tokenizer splits the stored text, lowercased and truncated, into the
+	// terms of the inverted index and of BM25 ranking, and queries likewise.
+	// Nil means Words.
+	Tokenizer func(text []byte) []string
+	// Stopwords are terms left out of the index and of queries.
+	Stopwords []string
+	BM25      BM25
+	// Threads is the number of goroutines a search scans the points with.
+	// Zero means one per core.
+	Threads int
 }
 
 type Service struct {
@@ -20,17 +36,53 @@ type Service struct {
 	labelInnerMap map[string]uint32
 	labelOuterMap map[uint32]string
 	rwMtx         sync.RWMutex
-	points        map[uint32]*point
+	threads       int
+	substring     bool
+	words         bool
+	tokenizer     func(text []byte) []string
+	stopwords     map[string]struct{}
+	bm25          BM25
+	totalLength   int
+	points        []point
+	vectors       []float32
+	norms         []float32
+	slots         map[uint32]int
+	postings      map[string][]posting
 }
 
 func New(cfg *Configuration) *Service {
+	tokenizer := cfg.Tokenizer
+	if tokenizer == nil {
+		tokenizer = Words
+	}
+
+	stopwords := make(map[string]struct{}, len(cfg.Stopwords))
+	for _, stopword := range cfg.Stopwords {
+		stopwords[stopword] = struct{}{}
+	}
+
+	bm25 := cfg.BM25
+	if bm25 == (BM25{}) {
+		bm25 = DefaultBM25
+	}
+
 	return &Service{
 		dim:           cfg.Dim,
 		nextIndex:     0,
 		labelInnerMap: make(map[string]uint32, cfg.MaxElements),
 		labelOuterMap: make(map[uint32]string, cfg.MaxElements),
 		rwMtx:         sync.RWMutex{},
-		points:        make(map[uint32]*point, cfg.MaxElements),
+		threads:       cfg.Threads,
+		substring:     cfg.Substring,
+		words:         cfg.Tokenizer == nil,
+		tokenizer:     tokenizer,
+		stopwords:     stopwords,
+		bm25:          bm25,
+		points:        make([]point, 0, cfg.MaxElements),
+		vectors:       make([]float32, 0, int(cfg.MaxElements)*cfg.Dim),
+		norms:         make([]float32, 0, cfg.MaxElements),
+		slots:         make(map[uint32]int, cfg.MaxElements),
+		postings:      make(map[string][]posting),
 	}
 }
 
@@ -68,9 +120,9 @@ func (s *Service) createNewLabelUnSafe(outerLabel string) uint32 {
 	return innerLabel
 }
 
-func (s *Service) Put(outerLabel string, text []byte, vector []float32) {
+func (s *Service) Put(outerLabel string, text []byte, vector []float32, opts ...graph.PutOption) error {
 	if len(vector) != s.dim {
-		panic("put: vector length is not equal to dim")
+		return graph.ErrDimensionMismatch
 	}
 
 	if len(text) > 1024 {
@@ -86,7 +138,7 @@ func (s *Service) Put(outerLabel string, text []byte, vector []float32) {
 		innerLabel = s.createNewLabelUnSafe(outerLabel)
 	}
 
-	s.addPoint(text, vector, innerLabel)
+	return s.addPoint(text, vector, innerLabel, graph.ApplyPutOptions(opts))
 }
 
 func (s *Service) ListIDs() []string {
@@ -114,22 +166,152 @@ func (s *Service) IndexesLoaded() uint32 {
 	return s.nextIndex
 }
 
-func (s *Service) Delete(outerLabel string) {
-	panic("not implemented")
+// Upsert stores vector under outerLabel, keeping any text already stored.
+func (s *Service) Upsert(outerLabel string, vector []float32, opts ...graph.PutOption) error {
+	if len(vector) != s.dim {
+		return graph.ErrDimensionMismatch
+	}
+
+	s.rwMtx.Lock()
+	defer s.rwMtx.Unlock()
+
+	var text []byte
+	innerLabel, found := s.findInnerLabelUnsafe(outerLabel)
+	if found {
+		text = s.point(innerLabel).text
+	} else {
+		innerLabel = s.createNewLabelUnSafe(outerLabel)
+	}
+
+	return s.addPoint(text, vector, innerLabel, graph.ApplyPutOptions(opts))
+}
+
+// Get returns a copy of the vector stored under outerLabel. Vectors are kept
+// as given, not normalized.
+func (s *Service) Get(outerLabel string) ([]float32, bool) {
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	innerLabel, found := s.findInnerLabelUnsafe(outerLabel)
+	if !found {
+		return nil, false
+	}
+
+	return append([]float32(nil), s.vector(s.slots[innerLabel])...), true
+}
+
+// GetMany is Get for several IDs at once. IDs that are not stored are left out
+// of the returned map.
+func (s *Service) GetMany(outerLabels []string) map[string][]float32 {
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	out := make(map[string][]float32, len(outerLabels))
+	for _, outerLabel := range outerLabels {
+		innerLabel, found := s.findInnerLabelUnsafe(outerLabel)
+		if !found {
+			continue
+		}
+		out[outerLabel] = append([]float32(nil), s.vector(s.slots[innerLabel])...)
+	}
+
+	return out
+}
+
+// Text returns the lowercased, truncated text stored under outerLabel.
+func (s *Service) Text(outerLabel string) ([]byte, bool) {
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	innerLabel, found := s.findInnerLabelUnsafe(outerLabel)
+	if !found {
+		return nil, false
+	}
+
+	return append([]byte(nil), s.point(innerLabel).text...), true
+}
+
+// Metadata returns the payload stored under outerLabel, nil when it has none.
+func (s *Service) Metadata(outerLabel string) (*metadata.Metadata, bool) {
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	innerLabel, found := s.findInnerLabelUnsafe(outerLabel)
+	if !found {
+		return nil, false
+	}
+
+	return s.point(innerLabel).metadata, true
+}
+
+func (s *Service) Count() int {
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	return len(s.labelInnerMap)
+}
+
+// Range calls fn for every stored ID until fn returns false. It iterates over
+// a copy, so fn may call back into the service.
+func (s *Service) Range(fn func(outerLabel string) bool) {
+	for _, outerLabel := range s.ListIDs() {
+		if !fn(outerLabel) {
+			return
+		}
+	}
+}
+
+func (s *Service) Delete(outerLabel string) error {
+	s.rwMtx.Lock()
+	defer s.rwMtx.Unlock()
+
+	innerLabel, found := s.findInnerLabelUnsafe(outerLabel)
+	if !found {
+		return graph.ErrUnknownLabel
+	}
+
+	s.deletePoint(innerLabel)
+	delete(s.labelInnerMap, outerLabel)
+	delete(s.labelOuterMap, innerLabel)
+
+	return nil
+}
+
+// Search scores every stored point by cosine distance, keeping those whose
+// text contains every one of contains: its terms, or with
+// Configuration.Substring, it as a substring. Without a vector the points are ranked
+// by the BM25 score of the words of contains and of opts.Query instead, as by
+// SearchText; when there are none they are all at UnrankedDistance.
+//
+// The scan runs on Configuration.Threads goroutines, so a Where condition
+// may be evaluated concurrently; a Filter is not.
+func (s *Service) Search(contains [][]byte, vectors []float32, resultsNum int) ([]graph.Result, error) {
+	return s.SearchWithOptions(vectors, resultsNum, graph.SearchOptions{Contains: contains})
 }
 
-func (s *Service) Search(contains [][]byte, vectors []float32, resultsNum int) map[string]float32 {
+func (s *Service) SearchWithOptions(vectors []float32, resultsNum int, opts graph.SearchOptions) ([]graph.Result, error) {
 	if len(vectors) != s.dim && len(vectors) != 0 {
-		log.Println("search: vector length is not equal to dim")
-		return nil
+		return nil, graph.ErrDimensionMismatch
 	}
 
 	s.rwMtx.RLock()
 	defer s.rwMtx.RUnlock()
 
-	innerLabels, distances := s.searchPoint(contains, vectors, resultsNum)
+	if len(vectors) == 0 {
+		queries := opts.Contains
+		if opts.Query != nil {
+			for _, word := range query.Words(opts.Query) {
+				queries = append(queries[:len(queries):len(queries)], []byte(word))
+			}
+		}
+		if terms := s.queryTerms(queries); len(terms) > 0 {
+			return s.textResultsUnsafe(s.searchText(opts, terms, resultsNum)), nil
+		}
+	}
+
+	innerLabels, distances := s.searchPoint(opts, vectors, resultsNum)
 
-	results := make(map[string]float32, len(innerLabels))
+	results := make([]graph.Result, len(innerLabels))
 
 	for i, innerLabel := range innerLabels {
 		outerLabel, found := s.findOuterLabelUnsafe(innerLabel)
@@ -137,8 +319,85 @@ func (s *Service) Search(contains [][]byte, vectors []float32, resultsNum int) m
 			panic("outerLabel not found")
 		}
 
-		results[outerLabel] = distances[i]
+		results[i] = graph.Result{
+			ID:       outerLabel,
+			Distance: distances[i],
+			Score:    graph.SpaceTypeCosine.Score(distances[i]),
+			Metadata: s.point(innerLabel).metadata,
+		}
+	}
+
+	graph.SortResults(results)
+
+	return results, nil
+}
+
+// SearchByID returns the resultsNum nearest neighbours of the vector stored
+// under outerLabel, leaving out outerLabel itself. It returns ErrUnknownLabel
+// when outerLabel is not stored.
+func (s *Service) SearchByID(outerLabel string, resultsNum int, opts graph.SearchOptions) ([]graph.Result, error) {
+	vector, found := s.Get(outerLabel)
+	if !found {
+		return nil, graph.ErrUnknownLabel
+	}
+
+	results, err := s.SearchWithOptions(vector, resultsNum+1, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return graph.ExcludeID(results, outerLabel, resultsNum), nil
+}
+
+// SearchRadius returns the points within cosine distance radius of vectors,
+// closest first, at most limit of them; a non-positive limit returns all.
+func (s *Service) SearchRadius(vectors []float32, radius float32, limit int) ([]graph.Result, error) {
+	if len(vectors) != s.dim {
+		return nil, graph.ErrDimensionMismatch
 	}
 
-	return results
+	s.rwMtx.RLock()
+	defer s.rwMtx.RUnlock()
+
+	vectorNorm := norm(vectors)
+	parts := s.partitions(len(s.points))
+	found := make([][]graph.Result, parts)
+	scan(len(s.points), parts, func(part, from, to int) {
+		for slot := from; slot < to; slot++ {
+			dist := s.distance(vectors, vectorNorm, slot)
+			if dist > radius {
+				continue
+			}
+
+			p := &s.points[slot]
+			found[part] = append(found[part], graph.Result{
+				ID:       s.labelOuterMap[p.innerLabel],
+				Distance: dist,
+				Score:    graph.SpaceTypeCosine.Score(dist),
+				Metadata: p.metadata,
+			})
+		}
+	})
+
+	var results []graph.Result
+	for _, part := range found {
+		results = append(results, part...)
+	}
+
+	graph.SortResults(results)
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// SearchMap is Search returning id -> distance.
+func (s *Service) SearchMap(contains [][]byte, vectors []float32, resultsNum int) (map[string]float32, error) {
+	results, err := s.Search(contains, vectors, resultsNum)
+	if err != nil {
+		return nil, err
+	}
+	return graph.ResultsToMap(results), nil
 }
@@ -0,0 +1,290 @@
+package inmemory
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abilitylab/graph/pkg/graph"
+	"github.com/abilitylab/graph/pkg/metadata"
+	"github.com/abilitylab/graph/pkg/query"
+	vectormath "github.com/abilitylab/graph/pkg/vector"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestService(t *testing.T) *Service {
+	s := New(&Configuration{
+		Dim:         2,
+		MaxElements: 10,
+		SpaceType:   graph.SpaceTypeCosine,
+	})
+
+	require.NoError(t, s.Put("east", []byte("east wind"), []float32{1, 0}))
+	require.NoError(t, s.Put("north", []byte("north wind"), []float32{0, 1}))
+	require.NoError(t, s.Put("north-east", []byte("north east"), []float32{1, 1}))
+	require.NoError(t, s.Put("also-east", []byte("east again"), []float32{2, 0}))
+
+	return s
+}
+
+func TestSearch(t *testing.T) {
+	s := newTestService(t)
+
+	results, err := s.Search(nil, []float32{1, 0}, 10)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	require.Equal(t, "also-east", results[0].ID)
+	require.Equal(t, "east", results[1].ID)
+	require.Equal(t, "north-east", results[2].ID)
+	require.InDelta(t, 1, results[0].Score, 1e-6)
+
+	results, err = s.Search([][]byte{[]byte("wind")}, []float32{1, 0}, 10)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, "east", results[0].ID)
+
+	_, err = s.Search(nil, []float32{1, 0, 0}, 10)
+	require.ErrorIs(t, err, graph.ErrDimensionMismatch)
+}
+
+func TestDelete(t *testing.T) {
+	s := newTestService(t)
+
+	require.NoError(t, s.Delete("east"))
+	require.ErrorIs(t, s.Delete("east"), graph.ErrUnknownLabel)
+
+	results, err := s.SearchMap(nil, []float32{1, 0}, 10)
+	require.NoError(t, err)
+	require.NotContains(t, results, "east")
+	require.Contains(t, results, "also-east")
+}
+
+func TestMetadata(t *testing.T) {
+	s := newTestService(t)
+
+	md := &metadata.Metadata{Tags: map[string][]string{"category": {"weather"}}}
+	require.NoError(t, s.Put("east", []byte("east wind"), []float32{1, 0}, graph.WithMetadata(md)))
+	require.NoError(t, s.Upsert("east", []float32{1, 0.1}))
+
+	results, err := s.SearchWithOptions([]float32{1, 0}, 10, graph.SearchOptions{Where: metadata.TagEquals("category", "weather")})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, "east", results[0].ID)
+	require.Equal(t, md, results[0].Metadata)
+
+	results, err = s.SearchWithOptions([]float32{1, 0}, 10, graph.SearchOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+}
+
+func TestParallelScan(t *testing.T) {
+	const n, dim = 3 * minPartition, 8
+	s := New(&Configuration{Dim: dim, SpaceType: graph.SpaceTypeCosine, Threads: 4})
+
+	r := rand.New(rand.NewSource(1))
+	vectors := make(map[string][]float32, n)
+	for i := 0; i < n; i++ {
+		vector := make([]float32, dim)
+		for j := range vector {
+			vector[j] = r.Float32()
+		}
+		id := strconv.Itoa(i)
+		vectors[id] = vector
+		require.NoError(t, s.Put(id, nil, vector))
+	}
+	// deleting moves the last points into the freed slots
+	for i := 0; i < n; i += 3 {
+		id := strconv.Itoa(i)
+		require.NoError(t, s.Delete(id))
+		delete(vectors, id)
+	}
+	require.Equal(t, 2*n/3, s.Count())
+	require.Equal(t, vectors, s.GetMany(s.ListIDs()))
+
+	query := vectors["1"]
+	var expected []graph.Result
+	for id, vector := range vectors {
+		expected = append(expected, graph.Result{ID: id, Distance: 1 - vectormath.Cosine32(query, vector)})
+	}
+	graph.SortResults(expected)
+
+	results, err := s.Search(nil, query, 50)
+	require.NoError(t, err)
+	require.Len(t, results, 50)
+	for i, result := range results {
+		require.Equal(t, expected[i].ID, result.ID)
+		require.InDelta(t, expected[i].Distance, result.Distance, 1e-5)
+	}
+
+	radius := (expected[99].Distance + expected[100].Distance) / 2
+	results, err = s.SearchRadius(query, radius, 0)
+	require.NoError(t, err)
+	require.Len(t, results, 100)
+	require.Equal(t, expected[42].ID, results[42].ID)
+}
+
+func TestContains(t *testing.T) {
+	s := newTestService(t)
+	search := func(contains ...string) []string {
+		var ids []string
+		results, err := s.Search(bytesOf(contains), []float32{1, 1}, 10)
+		require.NoError(t, err)
+		for _, result := range results {
+			ids = append(ids, result.ID)
+		}
+		return ids
+	}
+
+	require.Equal(t, []string{"east", "north"}, search("Wind"))
+	require.Equal(t, []string{"north-east"}, search("north", "east"))
+	require.Equal(t, []string{"north-east"}, search("east north"))
+	require.Empty(t, search("win"))
+	require.Empty(t, search("wind", "again"))
+
+	require.NoError(t, s.Put("east", []byte("east breeze"), []float32{1, 0}))
+	require.Equal(t, []string{"north"}, search("wind"))
+	require.NoError(t, s.Delete("north"))
+	require.Empty(t, search("wind"))
+	require.Equal(t, []string{"east"}, search("breeze"))
+
+	// stopwords are not indexed and match as substrings
+	s = New(&Configuration{Dim: 2, SpaceType: graph.SpaceTypeCosine, Stopwords: []string{"the"}})
+	require.NoError(t, s.Put("east", []byte("the east wind"), []float32{1, 0}))
+	require.NoError(t, s.Put("north", []byte("north windward"), []float32{1, 1}))
+	require.Equal(t, []string{"east"}, search("the"))
+	require.Equal(t, []string{"east"}, search("the wind"))
+
+	s = New(&Configuration{Dim: 2, SpaceType: graph.SpaceTypeCosine, Stopwords: []string{"the"}, Substring: true})
+	require.NoError(t, s.Put("east", []byte("the east wind"), []float32{1, 0}))
+	require.NoError(t, s.Put("north", []byte("north windward"), []float32{1, 1}))
+	require.Equal(t, []string{"north", "east"}, search("win"))
+	require.Equal(t, []string{"north"}, search("ward"))
+	require.Equal(t, []string{"east"}, search("he"))
+	require.Equal(t, []string{"east"}, search("the east"))
+	require.Equal(t, []string{"east"}, search("st wi"))
+	require.Empty(t, search("east north"))
+}
+
+func bytesOf(strs []string) [][]byte {
+	out := make([][]byte, len(strs))
+	for i, str := range strs {
+		out[i] = []byte(str)
+	}
+	return out
+}
+
+func TestBM25(t *testing.T) {
+	s := New(&Configuration{Dim: 2, SpaceType: graph.SpaceTypeCosine, Stopwords: []string{"the"}})
+	require.NoError(t, s.Put("d1", []byte("The cat, the dog"), []float32{1, 0}))
+	require.NoError(t, s.Put("d2", []byte("dog"), []float32{1, 0}))
+	require.NoError(t, s.Put("d3", []byte("bird bird"), []float32{1, 0}))
+
+	// three points of 5 terms, "cat" in one of them
+	idf := math.Log(1 + (3-1+0.5)/(1+0.5))
+	results := s.SearchText([]byte("Cat"), 10, graph.SearchOptions{})
+	require.Len(t, results, 1)
+	require.Equal(t, "d1", results[0].ID)
+	require.InDelta(t, idf*2.2/(1+1.2*(0.25+0.75*2/(5.0/3))), results[0].Score, 1e-5)
+
+	// the shorter text ranks first
+	results = s.SearchText([]byte("dog"), 10, graph.SearchOptions{})
+	require.Len(t, results, 2)
+	require.Equal(t, "d2", results[0].ID)
+	require.Greater(t, results[0].Score, results[1].Score)
+	require.Less(t, results[0].Distance, results[1].Distance)
+
+	require.Empty(t, s.SearchText([]byte("the"), 10, graph.SearchOptions{}))
+	results = s.SearchText([]byte("dog"), 10, graph.SearchOptions{Filter: func(id string) bool { return id != "d2" }})
+	require.Len(t, results, 1)
+	require.Equal(t, "d1", results[0].ID)
+
+	// without a vector contains is ranked and must all match
+	results, err := s.Search([][]byte{[]byte("dog"), []byte("cat")}, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, "d1", results[0].ID)
+
+	require.NoError(t, s.Delete("d1"))
+	require.Empty(t, s.SearchText([]byte("cat"), 10, graph.SearchOptions{}))
+
+	// nothing to rank by
+	results, err = s.Search(nil, nil, 10)
+	require.NoError(t, err)
+	require.Equal(t, []graph.Result{
+		{ID: "d2", Distance: UnrankedDistance},
+		{ID: "d3", Distance: UnrankedDistance},
+	}, results)
+	// contains is still checked
+	require.NoError(t, s.Put("d4", []byte("the end -- at last"), []float32{1, 0}))
+	for _, contain := range []string{"the", "--"} {
+		results, err = s.Search([][]byte{[]byte(contain)}, nil, 10)
+		require.NoError(t, err)
+		require.Equal(t, []graph.Result{{ID: "d4", Distance: UnrankedDistance}}, results)
+	}
+
+	s = New(&Configuration{Dim: 2, SpaceType: graph.SpaceTypeCosine, Tokenizer: func(text []byte) []string {
+		return strings.Fields(string(text))
+	}})
+	require.NoError(t, s.Put("d1", []byte("c++ go"), []float32{1, 0}))
+	require.NoError(t, s.Put("d2", []byte("c go"), []float32{1, 0}))
+	results = s.SearchText([]byte("C++"), 10, graph.SearchOptions{})
+	require.Len(t, results, 1)
+	require.Equal(t, "d1", results[0].ID)
+}
+
+func TestQuery(t *testing.T) {
+	s := New(&Configuration{Dim: 2, SpaceType: graph.SpaceTypeCosine})
+	put := func(id, text, category string, views float64) {
+		md := &metadata.Metadata{
+			Tags:    map[string][]string{"category": {category}},
+			Numbers: map[string]float64{"views": views},
+			Times:   map[string]time.Time{"published_at": time.Date(2024, 5, int(views)/10, 0, 0, 0, 0, time.UTC)},
+		}
+		require.NoError(t, s.Put(id, []byte(text), []float32{1, 0}, graph.WithMetadata(md)))
+	}
+	put("a", "Local news about the election", "politics", 10)
+	put("b", "news about local elections", "politics", 20)
+	put("c", "weather news", "weather", 10)
+
+	search := func(q string, vector []float32) []string {
+		parsed, err := query.Parse(q)
+		require.NoError(t, err, q)
+		results, err := s.SearchWithOptions(vector, 10, graph.SearchOptions{Query: parsed})
+		require.NoError(t, err, q)
+		ids := make([]string, len(results))
+		for i, result := range results {
+			ids[i] = result.ID
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	for _, vector := range [][]float32{{1, 0}, nil} {
+		require.Equal(t, []string{"a", "b", "c"}, search(`news`, vector))
+		require.Equal(t, []string{"a", "b"}, search(`news AND local`, vector))
+		require.Equal(t, []string{"a", "c"}, search(`election OR weather`, vector))
+		require.Equal(t, []string{"b", "c"}, search(`news NOT election`, vector))
+		require.Equal(t, []string{"a"}, search(`"local news"`, vector))
+		require.Equal(t, []string{"a", "b"}, search(`elect*`, vector))
+		require.Equal(t, []string{"c"}, search(`category:weather`, vector))
+		require.Equal(t, []string{"b", "c"}, search(`category:w* OR views:20`, vector))
+		require.Equal(t, []string{"a", "b"}, search(`text:local NOT category:weather`, vector))
+		require.Empty(t, search(`category:"local news"`, vector))
+		require.Equal(t, []string{"b"}, search(`published_at:2024-05-02`, vector))
+		require.Equal(t, []string{"a", "c"}, search(`published_at:"2024-05-01T00:00:00Z"`, vector))
+		require.Empty(t, search(`views:2024-05-02 OR published_at:news`, vector))
+	}
+
+	// without a vector the words of the query rank the results
+	parsed, err := query.Parse(`election OR category:weather`)
+	require.NoError(t, err)
+	results, err := s.SearchWithOptions(nil, 10, graph.SearchOptions{Query: parsed})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, "a", results[0].ID)
+	require.Zero(t, results[1].Score)
+}
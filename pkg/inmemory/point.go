@@ -2,82 +2,243 @@ package inmemory
 
 import (
 	"bytes"
-	"log"
-	"sort"
+	"runtime"
+	"sync"
 
-	vectormath "github.com/abilitylab/graph/pkg/vector"
+	"github.com/abilitylab/graph/pkg/graph"
+	"github.com/abilitylab/graph/pkg/metadata"
+	"github.com/chewxy/math32"
 )
 
+// Points live in slots: slot i holds its vector at vectors[i*dim:(i+1)*dim]
+// and the vector norm at norms[i], so that a search streams through one
+// contiguous slab. Deleting a point moves the last one into its slot.
 type point struct {
-	text   []byte
-	vector []float32
+	innerLabel uint32
+	text       []byte
+	// length is the number of terms of text.
+	length   int
+	metadata *metadata.Metadata
 }
 
-func (s *Service) addPoint(text []byte, vector []float32, innerLabel uint32) error {
-	s.points[innerLabel] = &point{
-		text:   text,
-		vector: vector,
+func (s *Service) vector(slot int) []float32 {
+	return s.vectors[slot*s.dim : (slot+1)*s.dim]
+}
+
+// point returns the point stored under innerLabel, which must exist.
+func (s *Service) point(innerLabel uint32) *point {
+	return &s.points[s.slots[innerLabel]]
+}
+
+func (s *Service) addPoint(text []byte, vector []float32, innerLabel uint32, opts graph.PutOptions) error {
+	slot, found := s.slots[innerLabel]
+	if found {
+		copy(s.vector(slot), vector)
+	} else {
+		slot = len(s.points)
+		s.slots[innerLabel] = slot
+		s.points = append(s.points, point{innerLabel: innerLabel})
+		s.vectors = append(s.vectors, vector...)
+		s.norms = append(s.norms, 0)
+	}
+
+	p := &s.points[slot]
+	if !found || !bytes.Equal(p.text, text) {
+		if found {
+			s.unindexText(p)
+		}
+		p.text = text
+		s.indexText(p)
 	}
+	if opts.Metadata != nil {
+		p.metadata = opts.Metadata
+	}
+	s.norms[slot] = norm(vector)
 
 	return nil
 }
 
+func (s *Service) deletePoint(innerLabel uint32) {
+	slot := s.slots[innerLabel]
+	s.unindexText(&s.points[slot])
+	last := len(s.points) - 1
+	if slot != last {
+		s.points[slot] = s.points[last]
+		copy(s.vector(slot), s.vector(last))
+		s.norms[slot] = s.norms[last]
+		s.slots[s.points[slot].innerLabel] = slot
+	}
+
+	s.points[last] = point{}
+	s.points = s.points[:last]
+	s.vectors = s.vectors[:last*s.dim]
+	s.norms = s.norms[:last]
+	delete(s.slots, innerLabel)
+}
+
+func dot(a, b []float32) float32 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return s0 + s1 + s2 + s3
+}
+
+func norm(vector []float32) float32 {
+	return math32.Sqrt(dot(vector, vector))
+}
+
+// distance is the cosine distance between vector, of norm vectorNorm, and the
+// point in slot. A zero vector is at distance 1 from everything.
+func (s *Service) distance(vector []float32, vectorNorm float32, slot int) float32 {
+	if vectorNorm == 0 || s.norms[slot] == 0 {
+		return 1
+	}
+	return 1 - dot(vector, s.vector(slot))/(vectorNorm*s.norms[slot])
+}
+
+// minPartition is the fewest points a search hands to one goroutine; below
+// that, starting the goroutine costs more than it saves.
+const minPartition = 1 << 14
+
+// partitions returns the number of goroutines a scan of n points uses.
+func (s *Service) partitions(n int) int {
+	threads := s.threads
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	parts := (n + minPartition - 1) / minPartition
+	if parts > threads {
+		parts = threads
+	}
+	if parts < 1 {
+		parts = 1
+	}
+	return parts
+}
+
+// scan splits [0, n) into parts consecutive ranges and calls visit on each
+// from its own goroutine, returning once all are done.
+func scan(n, parts int, visit func(part, from, to int)) {
+	if parts == 1 {
+		visit(0, 0, n)
+		return
+	}
+
+	var wg sync.WaitGroup
+	size := (n + parts - 1) / parts
+	for part := 0; part < parts; part++ {
+		from, to := part*size, (part+1)*size
+		if to > n {
+			to = n
+		}
+		wg.Add(1)
+		go func(part, from, to int) {
+			defer wg.Done()
+			visit(part, from, to)
+		}(part, from, to)
+	}
+	wg.Wait()
+}
+
+// allowed evaluates filter on the n points a scan visits ahead of it, as
+// filter need not be safe for concurrent use. slotAt maps the scan positions
+// to slots.
+func (s *Service) allowed(filter func(id string) bool, n int, slotAt func(i int) int) []bool {
+	if filter == nil {
+		return nil
+	}
+	allow := make([]bool, n)
+	for i := range allow {
+		allow[i] = filter(s.labelOuterMap[s.points[slotAt(i)].innerLabel])
+	}
+	return allow
+}
+
 const maxDistance = 0.6
 
-func (s *Service) searchPoint(contains [][]byte, vector []float32, resultsNum int) ([]uint32, []float32) {
-	var (
-		distancesMap = make(map[uint32]float32, resultsNum)
-		innerLabels  = make([]uint32, 0, resultsNum)
-		distances    = make([]float32, 0, resultsNum)
-	)
+// UnrankedDistance is the Distance of the results of a search with neither a
+// vector nor words to rank them by. Their Score is 0.
+const UnrankedDistance = 1
 
-	// TODO: parallelize this:
+func (s *Service) searchPoint(opts graph.SearchOptions, vector []float32, resultsNum int) ([]uint32, []float32) {
+	if resultsNum <= 0 {
+		return nil, nil
+	}
 
-	for innerLabel, point := range s.points {
-		if point == nil {
-			log.Println("searchPoint: point is nil")
-			continue
+	n, slotAt := len(s.points), func(i int) int { return i }
+	if len(opts.Contains) > 0 {
+		candidates, all := s.candidates(opts.Contains)
+		if !all {
+			n, slotAt = len(candidates), func(i int) int { return candidates[i] }
 		}
+	}
 
-		matches := true
-
-		if len(vector) == 0 {
-			distancesMap[innerLabel] = 0.5
-			continue
-		} else if len(contains) > 0 {
-			for _, contain := range contains {
-				if !bytes.Contains(point.text, contain) {
-					matches = false
-					break
-				}
+	allow := s.allowed(opts.Filter, n, slotAt)
+	match := s.queryMatch(opts.Query)
+	containsMatch := s.containsMatch(opts.Contains)
+	var vectorNorm float32
+	if len(vector) > 0 {
+		vectorNorm = norm(vector)
+	}
+
+	parts := s.partitions(n)
+	tops := make([]topK, parts)
+	scan(n, parts, func(part, from, to int) {
+		top := s.newTopK(resultsNum)
+
+		for i := from; i < to; i++ {
+			if allow != nil && !allow[i] {
+				continue
+			}
+
+			slot := slotAt(i)
+			p := &s.points[slot]
+			if opts.Where != nil && !opts.Where.Match(p.metadata) {
+				continue
+			}
+			if match != nil && !match(slot) {
+				continue
+			}
+			if containsMatch != nil && !containsMatch(slot) {
+				continue
 			}
-		}
 
-		if matches {
-			dist := 1.0 - vectormath.Cosine32(vector, point.vector)
+			if len(vector) == 0 {
+				top.offer(candidate{slot: slot, dist: UnrankedDistance})
+				continue
+			}
+
+			dist := s.distance(vector, vectorNorm, slot)
 			if dist <= maxDistance {
-				distancesMap[innerLabel] = dist
+				top.offer(candidate{slot: slot, dist: dist})
 			}
 		}
-	}
 
-	var sortedMap = make([]uint32, len(distancesMap))
-	i := 0
-	for innerLabel := range distancesMap {
-		sortedMap[i] = innerLabel
-		i++
-	}
-	sort.Slice(sortedMap, func(i, j int) bool {
-		return distancesMap[sortedMap[i]] < distancesMap[sortedMap[j]]
+		tops[part] = top
 	})
 
-	if len(sortedMap) > resultsNum { // TODO: this is limiting the results to the first resultsNum if we only use exact matches
-		sortedMap = sortedMap[:resultsNum]
+	top := tops[0]
+	for _, other := range tops[1:] {
+		for _, c := range other.items {
+			top.offer(c)
+		}
 	}
 
-	for _, key := range sortedMap {
-		innerLabels = append(innerLabels, key)
-		distances = append(distances, distancesMap[key])
+	best := top.sorted()
+	innerLabels := make([]uint32, len(best))
+	distances := make([]float32, len(best))
+	for i, c := range best {
+		innerLabels[i] = s.points[c.slot].innerLabel
+		distances[i] = c.dist
 	}
 
 	return innerLabels, distances
@@ -0,0 +1,124 @@
+package inmemory
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/abilitylab/graph/pkg/metadata"
+	"github.com/abilitylab/graph/pkg/query"
+)
+
+// compileQuery turns q into a match on slots, safe for concurrent use. Words
+// match terms of the inverted index whatever Configuration.Substring says. A
+// field term compares metadata the way a Where condition does, through
+// metadata.Equals, or metadata.TagPrefix for a prefix.
+func (s *Service) compileQuery(q query.Node) func(slot int) bool {
+	switch n := q.(type) {
+	case *query.And:
+		left, right := s.compileQuery(n.Left), s.compileQuery(n.Right)
+		return func(slot int) bool { return left(slot) && right(slot) }
+	case *query.Or:
+		left, right := s.compileQuery(n.Left), s.compileQuery(n.Right)
+		return func(slot int) bool { return left(slot) || right(slot) }
+	case *query.Not:
+		match := s.compileQuery(n.Node)
+		return func(slot int) bool { return !match(slot) }
+	case *query.Term:
+		if n.Field != "" && n.Field != query.TextField {
+			if n.Prefix {
+				return s.fieldMatch(metadata.TagPrefix(n.Field, n.Text))
+			}
+			return s.fieldMatch(metadata.Equals(n.Field, n.Text))
+		}
+		if n.Prefix {
+			return s.prefixMatch(n.Text)
+		}
+		return s.termsMatch(s.queryTerms([][]byte{[]byte(n.Text)}))
+	case *query.Phrase:
+		if n.Field != "" && n.Field != query.TextField {
+			return s.fieldMatch(metadata.Equals(n.Field, n.Text))
+		}
+		return s.phraseMatch(n.Text)
+	default:
+		return func(int) bool { return false }
+	}
+}
+
+// termsMatch matches the points holding every one of terms. Words the
+// tokenizer or the stopwords drop match everything.
+func (s *Service) termsMatch(terms []string) func(slot int) bool {
+	return func(slot int) bool {
+		innerLabel := s.points[slot].innerLabel
+		for _, term := range terms {
+			if !s.holds(innerLabel, term) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (s *Service) prefixMatch(prefix string) func(slot int) bool {
+	prefix = strings.ToLower(prefix)
+	var terms []string
+	for term := range s.postings {
+		if strings.HasPrefix(term, prefix) {
+			terms = append(terms, term)
+		}
+	}
+
+	return func(slot int) bool {
+		innerLabel := s.points[slot].innerLabel
+		for _, term := range terms {
+			if s.holds(innerLabel, term) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (s *Service) phraseMatch(phrase string) func(slot int) bool {
+	terms := s.terms(bytes.ToLower([]byte(phrase)))
+	holdsAll := s.termsMatch(terms)
+	if len(terms) < 2 {
+		return holdsAll
+	}
+
+	return func(slot int) bool {
+		// the index tells which points hold the words, not where
+		if !holdsAll(slot) {
+			return false
+		}
+		text := s.terms(s.points[slot].text)
+		for i := 0; i+len(terms) <= len(text); i++ {
+			if equalTerms(text[i:i+len(terms)], terms) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func equalTerms(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Service) fieldMatch(expr metadata.Expr) func(slot int) bool {
+	return func(slot int) bool {
+		return expr.Match(s.points[slot].metadata)
+	}
+}
+
+// queryMatch compiles opts.Query, nil when there is none.
+func (s *Service) queryMatch(q query.Node) func(slot int) bool {
+	if q == nil {
+		return nil
+	}
+	return s.compileQuery(q)
+}
@@ -0,0 +1,260 @@
+package inmemory
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The inverted index maps every term of the stored texts to postings sorted
+// by inner label, with the number of times the point holds the term.
+
+type posting struct {
+	innerLabel uint32
+	freq       uint32
+}
+
+// Words is the default tokenizer: it splits text into lowercased runs of
+// letters and digits.
+func Words(text []byte) []string {
+	return strings.FieldsFunc(strings.ToLower(string(text)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// terms tokenizes text, leaving out the stopwords.
+func (s *Service) terms(text []byte) []string {
+	terms := s.tokenizer(text)
+	if len(s.stopwords) == 0 {
+		return terms
+	}
+	out := terms[:0]
+	for _, term := range terms {
+		if _, stop := s.stopwords[term]; !stop {
+			out = append(out, term)
+		}
+	}
+	return out
+}
+
+// queryTerms returns the distinct terms of queries, lowercased as the stored
+// texts are.
+func (s *Service) queryTerms(queries [][]byte) []string {
+	var out []string
+	seen := make(map[string]struct{})
+	for _, query := range queries {
+		for _, term := range s.terms(bytes.ToLower(query)) {
+			if _, found := seen[term]; !found {
+				seen[term] = struct{}{}
+				out = append(out, term)
+			}
+		}
+	}
+	return out
+}
+
+func searchPostings(postings []posting, innerLabel uint32) int {
+	return sort.Search(len(postings), func(i int) bool { return postings[i].innerLabel >= innerLabel })
+}
+
+func (s *Service) indexText(p *point) {
+	freqs := make(map[string]uint32)
+	for _, term := range s.terms(p.text) {
+		freqs[term]++
+		p.length++
+	}
+	s.totalLength += p.length
+
+	for term, freq := range freqs {
+		postings := s.postings[term]
+		i := searchPostings(postings, p.innerLabel)
+		postings = append(postings, posting{})
+		copy(postings[i+1:], postings[i:])
+		postings[i] = posting{innerLabel: p.innerLabel, freq: freq}
+		s.postings[term] = postings
+	}
+}
+
+func (s *Service) unindexText(p *point) {
+	s.totalLength -= p.length
+	p.length = 0
+
+	for _, term := range s.terms(p.text) {
+		postings := s.postings[term]
+		i := searchPostings(postings, p.innerLabel)
+		if i == len(postings) || postings[i].innerLabel != p.innerLabel {
+			continue
+		}
+		if len(postings) == 1 {
+			delete(s.postings, term)
+			continue
+		}
+		s.postings[term] = append(postings[:i], postings[i+1:]...)
+	}
+}
+
+// holds reports whether the point stored under innerLabel holds term.
+func (s *Service) holds(innerLabel uint32, term string) bool {
+	postings := s.postings[term]
+	i := searchPostings(postings, innerLabel)
+	return i < len(postings) && postings[i].innerLabel == innerLabel
+}
+
+// containsMatch compiles contains into a match on slots, nil when there is
+// none. By default every term of a contains must be a term of the text; one
+// without terms, such as a stopword, and every one with
+// Configuration.Substring, must be a substring of it.
+func (s *Service) containsMatch(contains [][]byte) func(slot int) bool {
+	if len(contains) == 0 {
+		return nil
+	}
+
+	terms := make([][]string, len(contains))
+	if !s.substring {
+		for i, contain := range contains {
+			terms[i] = s.queryTerms([][]byte{contain})
+		}
+	}
+
+	return func(slot int) bool {
+		p := &s.points[slot]
+		for i, contain := range contains {
+			if len(terms[i]) == 0 {
+				if !bytes.Contains(p.text, contain) {
+					return false
+				}
+				continue
+			}
+			for _, term := range terms[i] {
+				if !s.holds(p.innerLabel, term) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+}
+
+// candidates returns the sorted slots of the points that may match contains,
+// from the inverted index. all reports that the index cannot narrow them
+// down, so every point may.
+func (s *Service) candidates(contains [][]byte) (slots []int, all bool) {
+	var lists [][]uint32
+	for _, contain := range contains {
+		if s.substring {
+			lists = append(lists, s.substringLabels(contain)...)
+			continue
+		}
+		for _, term := range s.queryTerms([][]byte{contain}) {
+			lists = append(lists, s.termLabels(term, nil))
+		}
+	}
+	if len(lists) == 0 {
+		return nil, true
+	}
+
+	// intersecting from the shortest list keeps every step small
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	labels := lists[0]
+	for _, list := range lists[1:] {
+		labels = intersect(labels, list)
+	}
+
+	slots = make([]int, len(labels))
+	for i, innerLabel := range labels {
+		slots[i] = s.slots[innerLabel]
+	}
+	sort.Ints(slots)
+	return slots, false
+}
+
+// substringLabels returns label lists every point holding contain as a
+// substring is in. Words of contain that runs past both their ends must be
+// terms of the text, the first must end one and the last begin one. This
+// scans the vocabulary, and is only known to hold for Words.
+func (s *Service) substringLabels(contain []byte) [][]uint32 {
+	if !s.words || !utf8.Valid(contain) {
+		return nil
+	}
+
+	var lists [][]uint32
+	words := Words(contain)
+	for i, word := range words {
+		var match func(term string) bool
+		switch {
+		case len(words) == 1:
+			match = func(term string) bool { return strings.Contains(term, word) }
+		case i == 0:
+			match = func(term string) bool { return strings.HasSuffix(term, word) }
+		case i == len(words)-1:
+			match = func(term string) bool { return strings.HasPrefix(term, word) }
+		}
+		if !s.matchesStopword(word, match) {
+			lists = append(lists, s.termLabels(word, match))
+		}
+	}
+	return lists
+}
+
+// matchesStopword reports whether word, or with match any term it accepts,
+// may be a stopword, which the index leaves out.
+func (s *Service) matchesStopword(word string, match func(term string) bool) bool {
+	if match == nil {
+		_, stop := s.stopwords[word]
+		return stop
+	}
+	for stopword := range s.stopwords {
+		if match(stopword) {
+			return true
+		}
+	}
+	return false
+}
+
+// termLabels returns the sorted inner labels of the points holding term, or
+// with match any term it accepts.
+func (s *Service) termLabels(term string, match func(term string) bool) []uint32 {
+	if match == nil {
+		postings := s.postings[term]
+		labels := make([]uint32, len(postings))
+		for i, posting := range postings {
+			labels[i] = posting.innerLabel
+		}
+		return labels
+	}
+
+	seen := make(map[uint32]struct{})
+	for term, postings := range s.postings {
+		if !match(term) {
+			continue
+		}
+		for _, posting := range postings {
+			seen[posting.innerLabel] = struct{}{}
+		}
+	}
+	labels := make([]uint32, 0, len(seen))
+	for innerLabel := range seen {
+		labels = append(labels, innerLabel)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+	return labels
+}
+
+// intersect returns the labels of a that b holds too. Both are sorted.
+func intersect(a, b []uint32) []uint32 {
+	var out []uint32
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			a = a[1:]
+		case a[0] > b[0]:
+			b = b[1:]
+		default:
+			out = append(out, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	return out
+}
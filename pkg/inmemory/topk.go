@@ -0,0 +1,63 @@
+package inmemory
+
+import (
+	"container/heap"
+	"sort"
+)
+
+type candidate struct {
+	slot int
+	dist float32
+}
+
+// topK keeps the k best candidates seen, the worst on top of a heap so that
+// most candidates are turned away with a single comparison.
+type topK struct {
+	k     int
+	items []candidate
+	worse func(a, b candidate) bool
+}
+
+// newTopK ranks candidates by distance, then by ID, the order of search
+// results.
+func (s *Service) newTopK(k int) topK {
+	return topK{
+		k: k,
+		worse: func(a, b candidate) bool {
+			if a.dist != b.dist {
+				return a.dist > b.dist
+			}
+			return s.labelOuterMap[s.points[a.slot].innerLabel] > s.labelOuterMap[s.points[b.slot].innerLabel]
+		},
+	}
+}
+
+func (t *topK) offer(c candidate) {
+	if len(t.items) < t.k {
+		heap.Push(t, c)
+		return
+	}
+	if t.worse(t.items[0], c) {
+		t.items[0] = c
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted returns the candidates best first.
+func (t *topK) sorted() []candidate {
+	sort.Slice(t.items, func(i, j int) bool {
+		return t.worse(t.items[j], t.items[i])
+	})
+	return t.items
+}
+
+func (t *topK) Len() int           { return len(t.items) }
+func (t *topK) Less(i, j int) bool { return t.worse(t.items[i], t.items[j]) }
+func (t *topK) Swap(i, j int)      { t.items[i], t.items[j] = t.items[j], t.items[i] }
+func (t *topK) Push(x any)         { t.items = append(t.items, x.(candidate)) }
+
+func (t *topK) Pop() any {
+	c := t.items[len(t.items)-1]
+	t.items = t.items[:len(t.items)-1]
+	return c
+}
@@ -0,0 +1,482 @@
+package metadata
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expr is a compiled filter expression.
+//
+// The grammar, keywords being case insensitive:
+//
+//	expr  = and { OR and }
+//	and   = unary { AND unary }
+//	unary = NOT unary | "(" expr ")" | field op value | field [NOT] IN "(" value { "," value } ")"
+//	op    = "=" | "!=" | "<" | "<=" | ">" | ">="
+//	value = "quoted string" | number
+//
+// A tag field matches "=" and IN when any of its tags is equal to a value.
+// Number fields compare numerically. Time fields compare against strings in
+// RFC 3339 or 2006-01-02 form, or numbers of unix seconds. A comparison on a
+// field the item does not have is false.
+//
+// Example: category IN ("politics", "world") AND published_at > "2023-01-01"
+type Expr interface {
+	Match(m *Metadata) bool
+}
+
+// SyntaxError reports where parsing failed. Pos is a byte offset into the
+// expression.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("metadata: syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+// Parse compiles a filter expression.
+func Parse(expr string) (Expr, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %q", t.text)}
+	}
+
+	return e, nil
+}
+
+// And matches when every expr matches. It returns nil, matching everything,
+// when exprs is empty.
+func And(exprs ...Expr) Expr {
+	if len(exprs) == 0 {
+		return nil
+	}
+	e := exprs[0]
+	for _, next := range exprs[1:] {
+		e = andExpr{e, next}
+	}
+	return e
+}
+
+// TagEquals is the expression field = "value".
+func TagEquals(field, value string) Expr {
+	return compareExpr{field: field, op: "=", value: newStringValue(value)}
+}
+
+// Equals is the expression field = value, value being a number when it
+// parses as one and a string otherwise, as in a query term.
+func Equals(field, value string) Expr {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return compareExpr{field: field, op: "=", value: newNumberValue(value)}
+	}
+	return TagEquals(field, value)
+}
+
+// TagPrefix matches when any tag of field begins with prefix.
+func TagPrefix(field, prefix string) Expr {
+	return prefixExpr{field: field, prefix: prefix}
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-'
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case c == '=' || c == '<' || c == '>' || c == '!':
+			j := i + 1
+			if j < len(s) && s[j] == '=' {
+				j++
+			}
+			op := s[i:j]
+			if op == "!" {
+				return nil, &SyntaxError{Pos: i, Msg: `expected "!="`}
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, &SyntaxError{Pos: i, Msg: "unterminated string"}
+			}
+			str, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, &SyntaxError{Pos: i, Msg: "invalid string"}
+			}
+			tokens = append(tokens, token{kind: tokenString, text: str, pos: i})
+			i = j + 1
+		case c == '-' || c == '+' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E' ||
+				(s[j] == '-' || s[j] == '+') && (s[j-1] == 'e' || s[j-1] == 'E')) {
+				j++
+			}
+			if _, err := strconv.ParseFloat(s[i:j], 64); err != nil {
+				return nil, &SyntaxError{Pos: i, Msg: fmt.Sprintf("invalid number %q", s[i:j])}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: s[i:j], pos: i})
+			i = j
+		default:
+			j := i
+			for j < len(s) {
+				r, size := utf8.DecodeRuneInString(s[j:])
+				if !isIdentRune(r) {
+					break
+				}
+				j += size
+			}
+			if j == i {
+				return nil, &SyntaxError{Pos: i, Msg: fmt.Sprintf("unexpected character %q", s[i])}
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: s[i:j], pos: i})
+			i = j
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, text: "end of expression", pos: len(s)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) keyword(t token, keyword string) bool {
+	return t.kind == tokenIdent && strings.EqualFold(t.text, keyword)
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("expected %s, found %q", what, t.text)}
+	}
+	return t, nil
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword(p.peek(), "OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword(p.peek(), "AND") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	t := p.peek()
+	switch {
+	case p.keyword(t, "NOT"):
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	case t.kind == tokenLParen:
+		p.next()
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+
+	field, err := p.expect(tokenIdent, "field name")
+	if err != nil {
+		return nil, err
+	}
+
+	t = p.next()
+	switch {
+	case t.kind == tokenOp:
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return compareExpr{field: field.text, op: t.text, value: v}, nil
+	case p.keyword(t, "IN"):
+		return p.parseIn(field.text)
+	case p.keyword(t, "NOT") && p.keyword(p.peek(), "IN"):
+		p.next()
+		e, err := p.parseIn(field.text)
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	default:
+		return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("expected operator or IN after %q, found %q", field.text, t.text)}
+	}
+}
+
+func (p *parser) parseIn(field string) (Expr, error) {
+	if _, err := p.expect(tokenLParen, `"("`); err != nil {
+		return nil, err
+	}
+
+	e := inExpr{field: field}
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		e.values = append(e.values, v)
+
+		t := p.next()
+		if t.kind == tokenRParen {
+			return e, nil
+		}
+		if t.kind != tokenComma {
+			return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf(`expected "," or ")", found %q`, t.text)}
+		}
+	}
+}
+
+func (p *parser) parseValue() (value, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return newStringValue(t.text), nil
+	case tokenNumber:
+		return newNumberValue(t.text), nil
+	default:
+		return value{}, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("expected string or number, found %q", t.text)}
+	}
+}
+
+func newNumberValue(s string) value {
+	n, _ := strconv.ParseFloat(s, 64)
+	sec := int64(n)
+	return value{str: s, num: n, isNum: true, time: time.Unix(sec, int64((n-float64(sec))*1e9)), isTime: true}
+}
+
+func newStringValue(s string) value {
+	v := value{str: s}
+	if t, ok := parseTime(s); ok {
+		v.time, v.isTime = t, true
+	}
+	return v
+}
+
+func parseTime(s string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+type value struct {
+	str    string
+	num    float64
+	isNum  bool
+	time   time.Time
+	isTime bool
+}
+
+type orExpr struct{ left, right Expr }
+
+func (e orExpr) Match(m *Metadata) bool { return e.left.Match(m) || e.right.Match(m) }
+
+type andExpr struct{ left, right Expr }
+
+func (e andExpr) Match(m *Metadata) bool { return e.left.Match(m) && e.right.Match(m) }
+
+type notExpr struct{ expr Expr }
+
+func (e notExpr) Match(m *Metadata) bool { return !e.expr.Match(m) }
+
+type compareExpr struct {
+	field string
+	op    string
+	value value
+}
+
+func (e compareExpr) Match(m *Metadata) bool {
+	if tags, ok := m.tags(e.field); ok {
+		switch e.op {
+		case "=":
+			return containsTag(tags, e.value.str)
+		case "!=":
+			return !containsTag(tags, e.value.str)
+		default:
+			return false
+		}
+	}
+
+	if n, ok := m.number(e.field); ok {
+		if !e.value.isNum {
+			return false
+		}
+		return compare(e.op, cmpFloat(n, e.value.num))
+	}
+
+	if t, ok := m.time(e.field); ok {
+		if !e.value.isTime {
+			return false
+		}
+		return compare(e.op, t.Compare(e.value.time))
+	}
+
+	return false
+}
+
+type inExpr struct {
+	field  string
+	values []value
+}
+
+func (e inExpr) Match(m *Metadata) bool {
+	for _, v := range e.values {
+		if (compareExpr{field: e.field, op: "=", value: v}).Match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+type prefixExpr struct {
+	field  string
+	prefix string
+}
+
+func (e prefixExpr) Match(m *Metadata) bool {
+	tags, _ := m.tags(e.field)
+	for _, t := range tags {
+		if strings.HasPrefix(t, e.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compare(op string, c int) bool {
+	switch op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	default:
+		return false
+	}
+}
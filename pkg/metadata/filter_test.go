@@ -0,0 +1,108 @@
+package metadata
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	published := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	md := &Metadata{
+		Tags:    map[string][]string{"category": {"politics", "world"}},
+		Numbers: map[string]float64{"views": 120},
+		Times:   map[string]time.Time{"published_at": published},
+	}
+
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{`category = "world"`, true},
+		{`category = "sport"`, false},
+		{`category != "sport"`, true},
+		{`category IN ("sport", "politics")`, true},
+		{`category not in ("sport", "politics")`, false},
+		{`views > 100`, true},
+		{`views <= 100`, false},
+		{`views >= 1.2e2`, true},
+		{`published_at > "2023-01-01"`, true},
+		{`published_at < "2023-05-01T11:00:00Z"`, false},
+		{`published_at = 1682942400`, true},
+		{`category IN ("politics") AND published_at > "2023-01-01"`, true},
+		{`category = "sport" OR views > 100`, true},
+		{`NOT (category = "sport" OR views > 100)`, false},
+		{`category = "sport" AND views > 100 OR views < 200`, true},
+		{`missing = "x"`, false},
+		{`NOT missing = "x"`, true},
+		{`views = "many"`, false},
+	}
+
+	for _, tt := range tests {
+		e, err := Parse(tt.expr)
+		require.NoError(t, err, tt.expr)
+		require.Equal(t, tt.match, e.Match(md), tt.expr)
+	}
+
+	e, err := Parse(`category = "world"`)
+	require.NoError(t, err)
+	require.False(t, e.Match(nil))
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+	}{
+		{``, 0},
+		{`category`, 8},
+		{`category = `, 11},
+		{`category = "world`, 11},
+		{`category IN ("a" "b")`, 17},
+		{`(views > 1`, 10},
+		{`views > 1 views`, 10},
+		{`views ! 1`, 6},
+		{`views > 1 AND $`, 14},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.expr)
+		var syntaxErr *SyntaxError
+		require.True(t, errors.As(err, &syntaxErr), tt.expr)
+		require.Equal(t, tt.pos, syntaxErr.Pos, tt.expr)
+	}
+}
+
+func TestAnd(t *testing.T) {
+	require.Nil(t, And())
+
+	md := &Metadata{Tags: map[string][]string{"category": {"world"}}, Numbers: map[string]float64{"views": 3}}
+	views, err := Parse(`views > 2`)
+	require.NoError(t, err)
+	require.True(t, And(TagEquals("category", "world"), views).Match(md))
+	require.False(t, And(TagEquals("category", "sport"), views).Match(md))
+}
+
+func TestEquals(t *testing.T) {
+	md := &Metadata{
+		Tags:    map[string][]string{"category": {"world", "20"}},
+		Numbers: map[string]float64{"views": 20},
+		Times:   map[string]time.Time{"published_at": time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	require.True(t, Equals("category", "world").Match(md))
+	require.True(t, Equals("category", "20").Match(md))
+	require.True(t, Equals("views", "20").Match(md))
+	require.True(t, Equals("views", "2e1").Match(md))
+	require.False(t, Equals("views", "many").Match(md))
+	require.True(t, Equals("published_at", "2024-05-01").Match(md))
+	require.True(t, Equals("published_at", "1714521600").Match(md))
+	require.False(t, Equals("published_at", "2024-05-02").Match(md))
+	require.False(t, Equals("missing", "x").Match(nil))
+
+	require.True(t, TagPrefix("category", "wor").Match(md))
+	require.False(t, TagPrefix("category", "sp").Match(md))
+	require.False(t, TagPrefix("views", "2").Match(md))
+}
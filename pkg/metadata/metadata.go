@@ -0,0 +1,38 @@
+package metadata
+
+import (
+	"time"
+)
+
+// Metadata is the payload stored next to a vector. Field names are shared
+// between the three kinds; a filter looks a field up in Tags, then Numbers,
+// then Times.
+type Metadata struct {
+	Tags    map[string][]string  `json:"tags,omitempty"`
+	Numbers map[string]float64   `json:"numbers,omitempty"`
+	Times   map[string]time.Time `json:"times,omitempty"`
+}
+
+func (m *Metadata) tags(field string) ([]string, bool) {
+	if m == nil {
+		return nil, false
+	}
+	v, ok := m.Tags[field]
+	return v, ok
+}
+
+func (m *Metadata) number(field string) (float64, bool) {
+	if m == nil {
+		return 0, false
+	}
+	v, ok := m.Numbers[field]
+	return v, ok
+}
+
+func (m *Metadata) time(field string) (time.Time, bool) {
+	if m == nil {
+		return time.Time{}, false
+	}
+	v, ok := m.Times[field]
+	return v, ok
+}
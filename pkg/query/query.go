@@ -0,0 +1,343 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Node is a node of a parsed query.
+//
+// The grammar, keywords being case insensitive as in package metadata:
+//
+//	query = and { OR and }
+//	and   = unary { [AND] unary }
+//	unary = NOT unary | "(" query ")" | [field ":"] ( word ["*"] | "quoted phrase" )
+//
+// Terms next to each other are ANDed. A word is a run of anything but
+// spaces, quotes, parentheses, ":" and "*"; a "*" right after it matches
+// every word it begins, and quoting a keyword searches for the word. A field
+// scopes the term to the metadata field of that name, or to the text for the
+// field "text".
+//
+// Example: election AND NOT "local news" OR category:politi*
+type Node interface {
+	String() string
+}
+
+type And struct {
+	Left, Right Node
+}
+
+type Or struct {
+	Left, Right Node
+}
+
+type Not struct {
+	Node Node
+}
+
+// Term is a word, or with Prefix every word it begins. Pos is the byte
+// offset of the term in the query, field included.
+type Term struct {
+	Field  string
+	Text   string
+	Prefix bool
+	Pos    int
+}
+
+// Phrase is a run of consecutive words.
+type Phrase struct {
+	Field string
+	Text  string
+	Pos   int
+}
+
+func (n *And) String() string { return "(" + n.Left.String() + " AND " + n.Right.String() + ")" }
+func (n *Or) String() string  { return "(" + n.Left.String() + " OR " + n.Right.String() + ")" }
+func (n *Not) String() string { return "NOT " + n.Node.String() }
+
+func (n *Term) String() string {
+	s := n.Text
+	if n.Prefix {
+		s += "*"
+	}
+	if n.Field != "" {
+		s = n.Field + ":" + s
+	}
+	return s
+}
+
+func (n *Phrase) String() string {
+	s := fmt.Sprintf("%q", n.Text)
+	if n.Field != "" {
+		s = n.Field + ":" + s
+	}
+	return s
+}
+
+// TextField is the field name scoping a term to the text.
+const TextField = "text"
+
+// Words returns the texts of the terms and phrases q looks for in the text,
+// leaving out prefixes and whatever is under a NOT. They are what a query
+// ranks on.
+func Words(q Node) []string {
+	var out []string
+	var walk func(n Node)
+	walk = func(n Node) {
+		switch n := n.(type) {
+		case *And:
+			walk(n.Left)
+			walk(n.Right)
+		case *Or:
+			walk(n.Left)
+			walk(n.Right)
+		case *Term:
+			if !n.Prefix && (n.Field == "" || n.Field == TextField) {
+				out = append(out, n.Text)
+			}
+		case *Phrase:
+			if n.Field == "" || n.Field == TextField {
+				out = append(out, n.Text)
+			}
+		}
+	}
+	walk(q)
+	return out
+}
+
+// SyntaxError reports where parsing failed. Pos is a byte offset into the
+// query.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("query: syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+// Parse parses a query.
+func Parse(q string) (Node, error) {
+	tokens, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %q", t.text)}
+	}
+
+	return n, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenPhrase
+	tokenLParen
+	tokenRParen
+	tokenColon
+	tokenStar
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	// glued is set when the token follows the previous one without space.
+	glued bool
+}
+
+func isWordRune(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune(`"():*`, r)
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+
+	glued := false
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		t := token{pos: i, glued: glued}
+		glued = true
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			glued = false
+			continue
+		case r == '(':
+			t.kind, t.text = tokenLParen, "("
+			i++
+		case r == ')':
+			t.kind, t.text = tokenRParen, ")"
+			i++
+		case r == ':':
+			t.kind, t.text = tokenColon, ":"
+			i++
+		case r == '*':
+			t.kind, t.text = tokenStar, "*"
+			i++
+		case r == '"':
+			j := strings.IndexByte(s[i+1:], '"')
+			if j < 0 {
+				return nil, &SyntaxError{Pos: i, Msg: "unterminated phrase"}
+			}
+			t.kind, t.text = tokenPhrase, s[i+1:i+1+j]
+			i += j + 2
+		default:
+			j := i
+			for j < len(s) {
+				r, size := utf8.DecodeRuneInString(s[j:])
+				if !isWordRune(r) {
+					break
+				}
+				j += size
+			}
+			t.kind, t.text = tokenWord, s[i:j]
+			i = j
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	return append(tokens, token{kind: tokenEOF, text: "end of query", pos: len(s)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) keyword(t token, keyword string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, keyword)
+}
+
+// startsUnary reports whether t begins a term, for implicit AND.
+func (p *parser) startsUnary(t token) bool {
+	switch t.kind {
+	case tokenWord:
+		return !p.keyword(t, "OR") && !p.keyword(t, "AND")
+	case tokenPhrase, tokenLParen:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *parser) parseOr() (Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword(p.peek(), "OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Or{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if p.keyword(p.peek(), "AND") {
+			p.next()
+		} else if !p.startsUnary(p.peek()) {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &And{Left: left, Right: right}
+	}
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	t := p.peek()
+	switch {
+	case p.keyword(t, "NOT"):
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Node: n}, nil
+	case t.kind == tokenLParen:
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokenRParen {
+			return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf(`expected ")", found %q`, t.text)}
+		}
+		return n, nil
+	}
+
+	return p.parseTerm()
+}
+
+func (p *parser) parseTerm() (Node, error) {
+	t := p.next()
+	pos := t.pos
+
+	var field string
+	if t.kind == tokenWord && p.peek().kind == tokenColon && p.peek().glued {
+		field = t.text
+		p.next()
+		t = p.next()
+		if !t.glued {
+			return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("expected term right after %q", field+":")}
+		}
+	}
+
+	switch t.kind {
+	case tokenPhrase:
+		if strings.TrimSpace(t.text) == "" {
+			return nil, &SyntaxError{Pos: t.pos, Msg: "empty phrase"}
+		}
+		return &Phrase{Field: field, Text: t.text, Pos: pos}, nil
+	case tokenWord:
+		if field == "" && (p.keyword(t, "AND") || p.keyword(t, "OR")) {
+			return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("expected term, found %q", t.text)}
+		}
+		n := &Term{Field: field, Text: t.text, Pos: pos}
+		if next := p.peek(); next.kind == tokenStar && next.glued {
+			p.next()
+			n.Prefix = true
+		}
+		return n, nil
+	default:
+		return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("expected term, found %q", t.text)}
+	}
+}
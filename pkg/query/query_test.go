@@ -0,0 +1,67 @@
+package query
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		query  string
+		parsed string
+	}{
+		{`election`, `election`},
+		{`election france`, `(election AND france)`},
+		{`election AND france OR spain`, `((election AND france) OR spain)`},
+		{`election (france OR spain)`, `(election AND (france OR spain))`},
+		{`NOT local election`, `(NOT local AND election)`},
+		{`"local news" OR elect*`, `("local news" OR elect*)`},
+		{`category:politics title:"local news" text:elect*`, `((category:politics AND title:"local news") AND text:elect*)`},
+		{`election and france or not spain`, `((election AND france) OR NOT spain)`},
+		{`c++ "and" "or" "not"`, `(((c++ AND "and") AND "or") AND "not")`},
+		{`NOT NOT x`, `NOT NOT x`},
+	}
+
+	for _, tt := range tests {
+		n, err := Parse(tt.query)
+		require.NoError(t, err, tt.query)
+		require.Equal(t, tt.parsed, n.String(), tt.query)
+	}
+
+	n, err := Parse(`a  category:b*`)
+	require.NoError(t, err)
+	require.Equal(t, &Term{Field: "category", Text: "b", Prefix: true, Pos: 3}, n.(*And).Right)
+
+	n, err = Parse(`x "a b" NOT y OR z* OR tag:w`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"x", "a b"}, Words(n))
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+	}{
+		{``, 0},
+		{`a AND`, 5},
+		{`a OR OR b`, 5},
+		{`(a b`, 4},
+		{`a)`, 1},
+		{`"a b`, 0},
+		{`a ""`, 2},
+		{`category: a`, 10},
+		{`* a`, 0},
+		{`a *`, 2},
+		{`AND a`, 0},
+		{`a or`, 4},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.query)
+		var syntaxErr *SyntaxError
+		require.True(t, errors.As(err, &syntaxErr), tt.query)
+		require.Equal(t, tt.pos, syntaxErr.Pos, tt.query)
+	}
+}